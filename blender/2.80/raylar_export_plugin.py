@@ -203,11 +203,22 @@ def export_camera(camera):
     z = (cam_direction[2] * 10) + position[2]
     target = [x, y, z, 1]
 
-    fov = bpy.data.cameras[camera.name].angle * 180 / math.pi
+    data = bpy.data.cameras[camera.name]
+    fov = data.angle * 180 / math.pi
     aspect = (
         bpy.context.scene.render.resolution_x /
         bpy.context.scene.render.resolution_y
     )
+    camera_type = "perspective"
+    if data.type == "ORTHO":
+        camera_type = "orthographic"
+    elif data.type == "PANO":
+        panorama = getattr(data.cycles, "panorama_type", "")
+        if panorama == "FISHEYE_EQUIDISTANT":
+            camera_type = "fisheye"
+            fov = data.cycles.fisheye_fov * 180 / math.pi
+        else:
+            camera_type = "equirectangular"
 
     return {
         "position": list(position),
@@ -217,7 +228,10 @@ def export_camera(camera):
         "aspect_ratio": aspect,
         "near": 0.01,
         "far": 10000,
-        "perspective": True,
+        "perspective": camera_type == "perspective",
+        "name": camera.name,
+        "type": camera_type,
+        "ortho_scale": data.ortho_scale,
     }
 
 
@@ -1,24 +1,81 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sinanislekdemir/raylar/raytracer"
 )
 
 var buildTime string
 
+// renderContext is cancelled on interrupt or when the timeout passes.
+// A second interrupt kills the process as usual.
+func renderContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			log.Printf("Stopping, interrupt again to quit right away")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+// regionFlags collects repeated --region flags.
+type regionFlags []raytracer.Region
+
+func (r *regionFlags) String() string {
+	regions := make([]string, len(*r))
+	for i := range *r {
+		regions[i] = (*r)[i].String()
+	}
+	return strings.Join(regions, " ")
+}
+
+func (r *regionFlags) Set(value string) error {
+	region, err := raytracer.ParseRegion(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, region)
+	return nil
+}
+
 func main() {
 	s := raytracer.Scene{}
 
 	sceneFile := ""
 
+	// serve, worker and merge commands come before the flags.
+	command := ""
+	if len(os.Args) > 1 && (os.Args[1] == "serve" || os.Args[1] == "worker" || os.Args[1] == "merge") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	configFile := flag.String("config", "", "Scene Config JSON")
 	outputFilename := flag.String("output", "awesome.png", "Render output image filename")
+	outputFormat := flag.String("format", "", "Output format: png, png16, tiff, exr, hdr, pfm. Defaults to output extension")
 	environmentMap := flag.String("environment", "", "Environment map image file for infinite reflections")
 	percent := flag.Int("percent", 100, "Render completion percentage")
 	size := flag.String("size", "", "width x height: Eg: 1600x900")
@@ -26,9 +83,37 @@ func main() {
 	right := flag.Int("right", 0, "Right X")
 	top := flag.Int("top", 0, "Top")
 	bottom := flag.Int("bottom", 0, "Bottom")
+	var regions regionFlags
+	flag.Var(&regions, "region", "Region to render as left,top,right,bottom, can be repeated")
+	crop := flag.Bool("crop", false, "Write only the rendered region instead of the full frame")
+	frames := flag.String("frames", "", "Frames to render for animated scenes, eg: 1-240")
+	camera := flag.String("camera", "", "Name of the camera to render, the first camera by default")
+	allCameras := flag.Bool("all-cameras", false, "Render every camera to its own output")
+	motionBlur := flag.Bool("motion-blur", false, "Blur objects and cameras moving while the shutter is open")
+	shutter := flag.Float64("shutter", 0, "Shutter interval in frames for motion blur, eg: 0.5")
 	profiling := flag.Bool("profile", false, "Set 1 for debugging")
 	showHelp := flag.Bool("help", false, "Show help!")
 	createConfig := flag.Bool("createconfig", false, "Create config")
+	progressive := flag.Bool("progressive", false, "Render progressively, writing the current estimate while rendering")
+	passCount := flag.Int("samples", 0, "Progressive rendering pass (sample per pixel) budget")
+	timeBudget := flag.Duration("time", 0, "Progressive rendering time budget, eg: 2h30m")
+	preview := flag.String("preview", "", "Progressive preview image filename, defaults to output")
+	checkpoint := flag.String("checkpoint", "", "Checkpoint filename, defaults to <output>.checkpoint")
+	resume := flag.Bool("resume", false, "Resume the render from its checkpoint")
+	denoise := flag.Bool("denoise", false, "Denoise the rendered image")
+	passes := flag.String("passes", "", "Comma separated render passes to write next to the output")
+	autoExposure := flag.String("auto-exposure", "", "Meter the exposure from the render: average or center_weighted")
+	timeout := flag.Duration("timeout", 0, "Stop the render after the duration, eg: 1h")
+	progress := flag.String("progress", "terminal", "Progress output: terminal, json or json-pixels")
+	port := flag.Int("port", 7400, "Port of the coordinator or the job server")
+	host := flag.String("host", "localhost", "Host the job server listens on, 0.0.0.0 for every interface")
+	distributed := flag.Bool("distributed", false, "Serve coordinates a distributed render of the scene instead of running the job server")
+	tileSize := flag.Int("tile", 64, "Tile size for distributed rendering")
+	jobs := flag.Int("jobs", 1, "Jobs rendered at a time by the job server")
+	jobsDir := flag.String("jobs-dir", "jobs", "Directory of uploaded scenes and job outputs for the job server")
+	jobRetention := flag.Duration("job-retention", 24*time.Hour, "Finished jobs are removed after the duration, 0 keeps them")
+	sceneRoot := flag.String("scene-root", "", "Directory of scenes jobs can name by path, jobs upload scenes if not set")
+	coordinatorURL := flag.String("coordinator", "http://localhost:7400", "Coordinator address for worker")
 
 	flag.Parse()
 
@@ -43,12 +128,48 @@ func main() {
 
 	if showHelp != nil && *showHelp {
 		fmt.Println("--config <config.json>  : Render configurations")
-		fmt.Println("--output <out.png>      : Output image filename")
+		fmt.Println("--output <out.png>      : Output image filename, .exr keeps linear unclamped colors and passes as layers")
+		fmt.Println("--format <format>       : png, png16, tiff, exr, hdr or pfm. Picked from output extension if not set")
 		fmt.Println("--percent <percent>     : Render Percentage")
 		fmt.Println("--profile               : Turn on profiling for golang")
 		fmt.Println("--size <width>x<height> : Set width x height explicitly, overwriting config. 1600x900 eg.")
+		fmt.Println("--region <l,t,r,b>      : Render only the region, right and bottom exclusive. Repeat for more regions,")
+		fmt.Println("                          each is written to <output>_l_t_r_b.<ext>")
+		fmt.Println("--crop                  : Write only the region instead of the full frame with the region filled in")
+		fmt.Println("--frames <first-last>   : Render a numbered image sequence of an animated scene, eg: 1-240")
+		fmt.Println("                          Output gets a _0001 suffix or #### in its name is replaced by the frame")
+		fmt.Println("--camera <name>         : Render through the named camera instead of the first one")
+		fmt.Println("--all-cameras           : Render every camera, each to <output>_<camera>.<ext>")
+		fmt.Println("--motion-blur           : Blur animated objects and cameras moving while the shutter is open")
+		fmt.Println("--shutter <frames>      : Shutter interval in frames, centered on the frame. 0.5 by default")
 		fmt.Println("--createconfig          : Create a default config.json to modify scene parameters")
 		fmt.Println("--environment           : Environment map image file for infinite reflections")
+		fmt.Println("--progressive           : Keep adding samples pass by pass, writing previews on the way")
+		fmt.Println("--samples <count>       : Progressive pass budget")
+		fmt.Println("--time <duration>       : Progressive time budget, eg: 45m or 2h")
+		fmt.Println("--preview <preview.png> : Progressive preview filename, output is overwritten if not set")
+		fmt.Println("--checkpoint <file>     : Checkpoint file written every checkpoint_interval seconds, <output>.checkpoint by default")
+		fmt.Println("--resume                : Resume a stopped render from its checkpoint")
+		fmt.Println("--denoise               : Denoise the image after rendering, useful with low sample counts")
+		fmt.Println("--passes <depth,normal> : Render passes to write next to the output image, one file each")
+		fmt.Printf("                          Available: %s\n", strings.Join(raytracer.RenderPasses, ", "))
+		fmt.Println("--auto-exposure <mode>  : Meter exposure from the rendered image, average or center_weighted")
+		fmt.Println("--timeout <duration>    : Stop the render after the duration, a checkpoint is kept for --resume")
+		fmt.Println("--progress <json>       : Write progress events to stdout as JSON lines instead of progress bars")
+		fmt.Println("                          json-pixels adds the colors of completed tiles, they can be the whole image")
+		fmt.Println("")
+		fmt.Println("raylar serve [flags]              : Run a job server rendering scenes posted to /jobs")
+		fmt.Println("  --port <port>                   : Port to listen, 7400 by default")
+		fmt.Println("  --host <host>                   : Host to listen, localhost by default")
+		fmt.Println("  --scene-root <dir>              : Scenes under dir can be named by path, only uploads if not set")
+		fmt.Println("  --jobs <count>                  : Jobs rendered at a time, 1 by default")
+		fmt.Println("  --jobs-dir <dir>                : Uploaded scenes and outputs, ./jobs by default")
+		fmt.Println("  --job-retention <duration>      : Remove finished jobs after the duration, 24h by default, 0 keeps them")
+		fmt.Println("raylar serve --distributed [flags] <scene.json> : Coordinate a distributed render, workers render the tiles")
+		fmt.Println("  --port <port>                   : Port to listen, 7400 by default")
+		fmt.Println("  --tile <size>                   : Tile size in pixels, 64 by default")
+		fmt.Println("raylar worker --coordinator <url> : Render tiles for a coordinator, http://localhost:7400 by default")
+		fmt.Println("raylar merge --output <full.png> <region.png>... : Stitch png or exr region renders into a full frame")
 		os.Exit(0)
 	}
 
@@ -57,6 +178,36 @@ func main() {
 	} else {
 		s.OutputFilename = *outputFilename
 	}
+	s.OutputFormat = *outputFormat
+	s.PreviewFilename = *preview
+	s.CheckpointFilename = *checkpoint
+	s.Resume = *resume
+	s.Crop = *crop
+	s.CameraName = *camera
+	s.AllCameras = *allCameras
+	switch *progress {
+	case "terminal":
+	case "json":
+		s.Reporter = raytracer.NewJSONReporter(os.Stdout)
+	case "json-pixels":
+		reporter := raytracer.NewJSONReporter(os.Stdout)
+		reporter.Pixels = true
+		s.Reporter = reporter
+	default:
+		log.Printf("Unknown progress output %s", *progress)
+		return
+	}
+	if *frames != "" {
+		var err error
+		s.Frames, err = raytracer.ParseFrames(*frames)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+	if *right+*left > 0 {
+		regions = append(regions, raytracer.Region{Left: *left, Top: *top, Right: *right, Bottom: *bottom})
+	}
 
 	if *profiling {
 		fx, _ := os.Create("profiling.prof")
@@ -64,11 +215,32 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	fmt.Printf("Raylar - Build %s", buildTime)
+	if s.Reporter == nil {
+		fmt.Printf("Raylar - Build %s", buildTime)
+	}
+	ctx, cancel := renderContext(*timeout)
+	defer cancel()
+	if command == "merge" {
+		err := raytracer.Merge(s.OutputFilename, s.OutputFormat, flag.Args(), s.Reporter)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+	if command == "worker" {
+		// Workers get the scene and configuration from the coordinator.
+		err := raytracer.Work(ctx, *coordinatorURL)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
 	if *createConfig {
 		err := raytracer.CreateConfig("config.json")
 		if err != nil {
 			fmt.Println(err.Error())
+		} else {
+			log.Printf("Created config.json")
 		}
 		return
 	}
@@ -77,18 +249,78 @@ func main() {
 		err := raytracer.CreateConfig("config.json")
 		if err != nil {
 			fmt.Println(err.Error())
+		} else {
+			log.Printf("Created config.json")
 		}
 	} else {
 		cf := "config.json"
 		configFile = &cf
 	}
 
-	err := s.Init(sceneFile, *configFile, *environmentMap)
+	if command == "serve" && !*distributed {
+		config := raytracer.DEFAULT
+		if *configFile != "" {
+			var err error
+			config, err = raytracer.LoadConfig(*configFile)
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+		}
+		server := raytracer.NewJobServer(config, *jobsDir, *jobs)
+		server.Retention = *jobRetention
+		server.Root = *sceneRoot
+		if s.Reporter != nil {
+			server.Reporter = s.Reporter
+		}
+		err := server.ListenAndServe(ctx, *host, *port)
+		if err != nil && err != context.Canceled {
+			log.Println(err.Error())
+		}
+		return
+	}
+
+	err := s.Init(ctx, sceneFile, *configFile, *environmentMap)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
 	log.Printf("Render %d percent of the image", *percent)
-	raytracer.GlobalConfig.Percentage = *percent
-	_ = raytracer.Render(&s, *left, *right, *top, *bottom, *percent, size)
+	s.Config.Percentage = *percent
+	if *progressive {
+		s.Config.Progressive = true
+	}
+	if *passCount > 0 {
+		s.Config.ProgressivePasses = *passCount
+	}
+	if *timeBudget > 0 {
+		s.Config.ProgressiveTime = timeBudget.Seconds()
+		if *passCount == 0 {
+			// Time budget alone runs until the time is up.
+			s.Config.ProgressivePasses = 0
+		}
+	}
+	if *denoise {
+		s.Config.Denoise = true
+	}
+	if *passes != "" {
+		s.Config.RenderPasses = strings.Split(*passes, ",")
+	}
+	if *autoExposure != "" {
+		s.Config.AutoExposure = *autoExposure
+	}
+	if *motionBlur {
+		s.Config.MotionBlur = true
+	}
+	if *shutter > 0 {
+		s.Config.Shutter = *shutter
+	}
+	if command == "serve" {
+		err = raytracer.Serve(ctx, &s, *size, *port, *tileSize)
+	} else {
+		err = raytracer.Render(ctx, &s, regions, *percent, size)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
 }
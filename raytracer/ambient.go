@@ -1,57 +1,68 @@
 package raytracer
 
+import (
+	"math"
+	"sync"
+)
+
+// ambientSample is an ambient ray hitting another surface, with the weight of its direction.
+type ambientSample struct {
+	hit    Intersection
+	weight float64
+}
+
 // Calculate light reflecting from other objects.
-func ambientLightCalc(scene *Scene, intersection *Intersection, samples []Intersection, totalDirs int) float64 {
-	totalHits := 0.0
+func ambientLightCalc(scene *Scene, intersection *Intersection, samples []ambientSample, totalDirs int) float64 {
+	occluded := 0.0
 	rad := scene.ShortRadius
-	if GlobalConfig.AmbientRadius > 0 {
-		rad = GlobalConfig.AmbientRadius
+	if scene.Config.AmbientRadius > 0 {
+		rad = scene.Config.AmbientRadius
 	}
 	for i := 0; i < len(samples); i++ {
-		if samples[i].Dist < rad {
-			totalHits++
+		if samples[i].hit.Dist < rad {
+			occluded += samples[i].weight
 		}
 	}
-	return 1.0 - (totalHits / float64(totalDirs))
+	// Uniform weights only average to 1, a few samples can overshoot.
+	return math.Max(0, 1.0-(occluded/float64(totalDirs)))
 }
 
-func ambientColor(scene *Scene, intersection *Intersection, samples []Intersection, totalDirs int) (result Vector) {
+// ambientColor is the weighted average color of the surfaces around.
+func ambientColor(scene *Scene, intersection *Intersection, samples []ambientSample) (result Vector) {
 	if !intersection.Hit {
 		return Vector{}
 	}
 
-	totalHits := 0.0
+	totalWeight := 0.0
 	totalColor := Vector{}
-	sampleCount := len(samples)
-	for i := 0; i < sampleCount; i++ {
-		color := samples[i].getColor()
-		if vectorLength(color) < DIFF {
-			continue
-		}
-		totalHits++
-		totalColor = addVector(totalColor, color)
+	for i := 0; i < len(samples); i++ {
+		totalWeight += samples[i].weight
+		totalColor = combine(totalColor, samples[i].hit.getColor(scene), 1, samples[i].weight)
 	}
-	if totalHits == 0 {
+	if totalWeight == 0 {
 		return Vector{}
 	}
 
-	return scaleVector(totalColor, 1.0/float64(sampleCount))
+	return scaleVector(totalColor, 1.0/totalWeight)
 }
 
-func ambientSampling(scene *Scene, intersection *Intersection) []Intersection {
-	sampleDirs := createSamples(intersection.IntersectionNormal, GlobalConfig.SamplerLimit, 0)
-	hitChannel := make(chan Intersection, len(sampleDirs))
+func ambientSampling(scene *Scene, intersection *Intersection) []ambientSample {
+	sampleDirs, weights := scene.hemisphereSamples(&intersection.sample, intersection.IntersectionNormal, scene.Config.SamplerLimit)
+	// Hits are kept in sample order, so sums don't depend on scheduling.
+	hits := make([]Intersection, len(sampleDirs))
+	var wg sync.WaitGroup
 	for i := range sampleDirs {
-		go func(scene *Scene, intersection *Intersection, dir Vector, channel chan Intersection) {
-			hit := raycastSceneIntersect(scene, intersection.Intersection, dir)
-			channel <- hit
-		}(scene, intersection, sampleDirs[i], hitChannel)
+		wg.Add(1)
+		go func(scene *Scene, intersection *Intersection, dir Vector, hit *Intersection) {
+			defer wg.Done()
+			*hit = raycastSceneIntersect(scene, intersection.Intersection, dir, intersection.Time)
+		}(scene, intersection, sampleDirs[i], &hits[i])
 	}
-	samples := make([]Intersection, 0, len(sampleDirs))
-	for i := 0; i < len(sampleDirs); i++ {
-		hit := <-hitChannel
+	wg.Wait()
+	samples := make([]ambientSample, 0, len(sampleDirs))
+	for i, hit := range hits {
 		if hit.Hit && hit.Triangle.id != intersection.Triangle.id {
-			samples = append(samples, hit)
+			samples = append(samples, ambientSample{hit: hit, weight: weights[i]})
 		}
 	}
 	return samples
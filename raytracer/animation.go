@@ -0,0 +1,518 @@
+package raytracer
+
+/*
+Animation. Objects, cameras and lights can carry keyframes which are
+interpolated for each frame of a sequence. Scene geometry and textures
+are prepared once; for every frame only the objects that moved are
+transformed again and the KD-tree is rebuilt only if something moved.
+*/
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Keyframe interpolation modes.
+const (
+	InterpolationLinear = "linear"
+	InterpolationBezier = "bezier"
+)
+
+// Keyframe is the frame number and how to interpolate towards the next key.
+type Keyframe struct {
+	Frame         float64 `json:"frame"`
+	Interpolation string  `json:"interpolation"`
+}
+
+// ObjectKeyframe is the object matrix at a frame.
+type ObjectKeyframe struct {
+	Keyframe
+	Matrix Matrix `json:"matrix"`
+}
+
+// CameraKeyframe is the camera pose at a frame.
+type CameraKeyframe struct {
+	Keyframe
+	Position Vector  `json:"position"`
+	Target   Vector  `json:"target"`
+	Fov      float64 `json:"fov"`
+}
+
+// LightKeyframe is the light state at a frame.
+type LightKeyframe struct {
+	Keyframe
+	Position      Vector  `json:"position"`
+	Color         Vector  `json:"color"`
+	LightStrength float64 `json:"light_strength"`
+	Direction     Vector  `json:"direction"`
+}
+
+type quaternion [4]float64
+
+// ParseFrames reads a frame range like 1-240, or a single frame.
+func ParseFrames(value string) ([]int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	first, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("frames %s: %s", value, err.Error())
+	}
+	last := first
+	if len(parts) == 2 {
+		last, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("frames %s: %s", value, err.Error())
+		}
+	}
+	if last < first {
+		return nil, fmt.Errorf("frames %s: last frame is before the first", value)
+	}
+	frames := make([]int, 0, last-first+1)
+	for f := first; f <= last; f++ {
+		frames = append(frames, f)
+	}
+	return frames, nil
+}
+
+// frameFilename numbers filename for frame. A run of # in the name is
+// replaced with the zero padded frame number, _0001 style suffix is
+// added otherwise.
+func frameFilename(filename string, frame int) string {
+	if filename == "" {
+		return filename
+	}
+	if start := strings.Index(filename, "#"); start >= 0 {
+		end := start
+		for end < len(filename) && filename[end] == '#' {
+			end++
+		}
+		return fmt.Sprintf("%s%0*d%s", filename[:start], end-start, frame, filename[end:])
+	}
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s_%04d%s", strings.TrimSuffix(filename, ext), frame, ext)
+}
+
+// checkKeyframes sorts keys by frame and validates them.
+func checkKeyframes(owner string, keys []Keyframe, swap func(i, j int)) error {
+	sort.Sort(keyframeSorter{keys: keys, swap: swap})
+	for i := range keys {
+		switch keys[i].Interpolation {
+		case "", InterpolationLinear, InterpolationBezier:
+		default:
+			return fmt.Errorf("%s: unknown keyframe interpolation %s", owner, keys[i].Interpolation)
+		}
+		if i > 0 && keys[i].Frame == keys[i-1].Frame {
+			return fmt.Errorf("%s: more than one keyframe at frame %g", owner, keys[i].Frame)
+		}
+	}
+	return nil
+}
+
+// keyframeSorter sorts the keys and the keyframes they belong to together.
+type keyframeSorter struct {
+	keys []Keyframe
+	swap func(i, j int)
+}
+
+func (k keyframeSorter) Len() int           { return len(k.keys) }
+func (k keyframeSorter) Less(i, j int) bool { return k.keys[i].Frame < k.keys[j].Frame }
+func (k keyframeSorter) Swap(i, j int) {
+	k.keys[i], k.keys[j] = k.keys[j], k.keys[i]
+	k.swap(i, j)
+}
+
+// checkAnimation sorts and validates every keyframe in the scene.
+func (s *Scene) checkAnimation() error {
+	var checkObjects func(objects map[string]*Object) error
+	checkObjects = func(objects map[string]*Object) error {
+		for name, obj := range objects {
+			obj := obj
+			keys := make([]Keyframe, len(obj.Keyframes))
+			for i := range obj.Keyframes {
+				keys[i] = obj.Keyframes[i].Keyframe
+			}
+			err := checkKeyframes("object "+name, keys, func(i, j int) {
+				obj.Keyframes[i], obj.Keyframes[j] = obj.Keyframes[j], obj.Keyframes[i]
+			})
+			if err != nil {
+				return err
+			}
+			if err := checkObjects(obj.Children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := checkObjects(s.Objects); err != nil {
+		return err
+	}
+	for c := range s.Cameras {
+		camera := &s.Cameras[c]
+		keys := make([]Keyframe, len(camera.Keyframes))
+		for i := range camera.Keyframes {
+			keys[i] = camera.Keyframes[i].Keyframe
+			// Keys without fov keep the camera fov.
+			if camera.Keyframes[i].Fov <= 0 {
+				camera.Keyframes[i].Fov = camera.Fov
+			}
+		}
+		err := checkKeyframes(fmt.Sprintf("camera %d", c), keys, func(i, j int) {
+			camera.Keyframes[i], camera.Keyframes[j] = camera.Keyframes[j], camera.Keyframes[i]
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for l := range s.Lights {
+		light := &s.Lights[l]
+		keys := make([]Keyframe, len(light.Keyframes))
+		for i := range light.Keyframes {
+			keys[i] = light.Keyframes[i].Keyframe
+			// Keys without color or direction keep the light's.
+			if light.Keyframes[i].Color == (Vector{}) {
+				light.Keyframes[i].Color = light.Color
+			}
+			if light.Keyframes[i].Direction == (Vector{}) {
+				light.Keyframes[i].Direction = light.Direction
+			}
+		}
+		err := checkKeyframes(fmt.Sprintf("light %d", l), keys, func(i, j int) {
+			light.Keyframes[i], light.Keyframes[j] = light.Keyframes[j], light.Keyframes[i]
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keySpan finds the key before frame and how far frame is towards the next key.
+func keySpan(keys []Keyframe, frame float64) (int, float64) {
+	last := len(keys) - 1
+	if frame <= keys[0].Frame {
+		return 0, 0
+	}
+	if frame >= keys[last].Frame {
+		return last, 0
+	}
+	i := sort.Search(len(keys), func(i int) bool { return keys[i].Frame > frame }) - 1
+	return i, (frame - keys[i].Frame) / (keys[i+1].Frame - keys[i].Frame)
+}
+
+// interpolateVectors between key i and i+1. Bezier handles follow the
+// neighbour keys so the motion doesn't stop at every key.
+func interpolateVectors(values []Vector, i int, t float64, mode string) Vector {
+	if t == 0 || i+1 >= len(values) {
+		return values[i]
+	}
+	a, b := values[i], values[i+1]
+	if mode != InterpolationBezier {
+		return combine(a, b, 1-t, t)
+	}
+	before, after := a, b
+	if i > 0 {
+		before = values[i-1]
+	}
+	if i+2 < len(values) {
+		after = values[i+2]
+	}
+	h1 := addVector(a, scaleVector(subVector(b, before), 1.0/6))
+	h2 := subVector(b, scaleVector(subVector(after, a), 1.0/6))
+	u := 1 - t
+	return addVectors(
+		scaleVector(a, u*u*u),
+		scaleVector(h1, 3*u*u*t),
+		scaleVector(h2, 3*u*t*t),
+		scaleVector(b, t*t*t),
+	)
+}
+
+func interpolateFloats(values []float64, i int, t float64, mode string) float64 {
+	vectors := make([]Vector, len(values))
+	for k := range values {
+		vectors[k][0] = values[k]
+	}
+	return interpolateVectors(vectors, i, t, mode)[0]
+}
+
+// decomposeMatrix splits an affine matrix into translation, scale and rotation.
+func decomposeMatrix(m Matrix) (translation, scale Vector, rotation quaternion) {
+	translation = Vector{m[3][0], m[3][1], m[3][2], 1}
+	var rows [3]Vector
+	for i := 0; i < 3; i++ {
+		rows[i] = Vector{m[i][0], m[i][1], m[i][2], 0}
+		scale[i] = vectorLength(rows[i])
+		if scale[i] > 0 {
+			rows[i] = scaleVector(rows[i], 1/scale[i])
+		}
+	}
+	// Mirrored matrices keep the mirror in the scale.
+	if dot(crossProduct(rows[0], rows[1]), rows[2]) < 0 {
+		scale[0] = -scale[0]
+		rows[0] = scaleVector(rows[0], -1)
+	}
+
+	// a is the column vector form of the rotation.
+	a := func(i, j int) float64 {
+		return rows[j][i]
+	}
+	trace := a(0, 0) + a(1, 1) + a(2, 2)
+	switch {
+	case trace > 0:
+		s := 0.5 / math.Sqrt(trace+1)
+		rotation = quaternion{(a(2, 1) - a(1, 2)) * s, (a(0, 2) - a(2, 0)) * s, (a(1, 0) - a(0, 1)) * s, 0.25 / s}
+	case a(0, 0) > a(1, 1) && a(0, 0) > a(2, 2):
+		s := 2 * math.Sqrt(1+a(0, 0)-a(1, 1)-a(2, 2))
+		rotation = quaternion{0.25 * s, (a(0, 1) + a(1, 0)) / s, (a(0, 2) + a(2, 0)) / s, (a(2, 1) - a(1, 2)) / s}
+	case a(1, 1) > a(2, 2):
+		s := 2 * math.Sqrt(1+a(1, 1)-a(0, 0)-a(2, 2))
+		rotation = quaternion{(a(0, 1) + a(1, 0)) / s, 0.25 * s, (a(1, 2) + a(2, 1)) / s, (a(0, 2) - a(2, 0)) / s}
+	default:
+		s := 2 * math.Sqrt(1+a(2, 2)-a(0, 0)-a(1, 1))
+		rotation = quaternion{(a(0, 2) + a(2, 0)) / s, (a(1, 2) + a(2, 1)) / s, 0.25 * s, (a(1, 0) - a(0, 1)) / s}
+	}
+	return translation, scale, rotation
+}
+
+func composeMatrix(translation, scale Vector, q quaternion) Matrix {
+	x, y, z, w := q[0], q[1], q[2], q[3]
+	a := [3][3]float64{
+		{1 - 2*(y*y+z*z), 2 * (x*y - z*w), 2 * (x*z + y*w)},
+		{2 * (x*y + z*w), 1 - 2*(x*x+z*z), 2 * (y*z - x*w)},
+		{2 * (x*z - y*w), 2 * (y*z + x*w), 1 - 2*(x*x+y*y)},
+	}
+	var m Matrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] = a[j][i] * scale[i]
+		}
+	}
+	m[3] = Vector{translation[0], translation[1], translation[2], 1}
+	return m
+}
+
+// slerp takes the shortest path between two rotations.
+func slerp(a, b quaternion, t float64) quaternion {
+	cos := a[0]*b[0] + a[1]*b[1] + a[2]*b[2] + a[3]*b[3]
+	if cos < 0 {
+		cos = -cos
+		b = quaternion{-b[0], -b[1], -b[2], -b[3]}
+	}
+	fa, fb := 1-t, t
+	if cos < 0.9995 {
+		theta := math.Acos(cos)
+		sin := math.Sin(theta)
+		fa = math.Sin((1-t)*theta) / sin
+		fb = math.Sin(t*theta) / sin
+	}
+	var result quaternion
+	length := 0.0
+	for i := range result {
+		result[i] = a[i]*fa + b[i]*fb
+		length += result[i] * result[i]
+	}
+	length = math.Sqrt(length)
+	for i := range result {
+		result[i] /= length
+	}
+	return result
+}
+
+// interpolateMatrices lerps translation and scale, slerps the rotation.
+// Bezier rotations ease in and out of the keys.
+func interpolateMatrices(values []Matrix, i int, t float64, mode string) Matrix {
+	if t == 0 || i+1 >= len(values) {
+		return values[i]
+	}
+	translations := make([]Vector, len(values))
+	scales := make([]Vector, len(values))
+	rotations := make([]quaternion, len(values))
+	for k := range values {
+		translations[k], scales[k], rotations[k] = decomposeMatrix(values[k])
+	}
+	rt := t
+	if mode == InterpolationBezier {
+		rt = t * t * (3 - 2*t)
+	}
+	return composeMatrix(
+		interpolateVectors(translations, i, t, mode),
+		interpolateVectors(scales, i, t, mode),
+		slerp(rotations[i], rotations[i+1], rt),
+	)
+}
+
+// matrixAt is the local matrix of the object at frame.
+func (o *Object) matrixAt(frame float64) Matrix {
+	if len(o.Keyframes) == 0 {
+		return o.localMatrix
+	}
+	keys := make([]Keyframe, len(o.Keyframes))
+	values := make([]Matrix, len(o.Keyframes))
+	for k := range o.Keyframes {
+		keys[k] = o.Keyframes[k].Keyframe
+		values[k] = o.Keyframes[k].Matrix
+	}
+	i, t := keySpan(keys, frame)
+	return interpolateMatrices(values, i, t, keys[i].Interpolation)
+}
+
+// worldMatrix of the object at frame, parent matrices come after the object's own.
+func (o *Object) worldMatrix(frame float64) Matrix {
+	m := o.matrixAt(frame)
+	for _, parent := range o.parents {
+		m = multiplyMatrix(m, parent.matrixAt(frame))
+	}
+	return m
+}
+
+// animated tells if the object or one of its parents has keyframes.
+func (o *Object) animated() bool {
+	if len(o.Keyframes) > 0 {
+		return true
+	}
+	for _, parent := range o.parents {
+		if len(parent.Keyframes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// storeLocalMatrices keeps the matrices from the scene file, flattening changes them.
+func storeLocalMatrices(objects map[string]*Object) {
+	for _, obj := range objects {
+		obj.localMatrix = obj.Matrix
+		storeLocalMatrices(obj.Children)
+	}
+}
+
+func (c *Camera) pose(frame float64) {
+	keys := make([]Keyframe, len(c.Keyframes))
+	positions := make([]Vector, len(c.Keyframes))
+	targets := make([]Vector, len(c.Keyframes))
+	fovs := make([]float64, len(c.Keyframes))
+	for k := range c.Keyframes {
+		keys[k] = c.Keyframes[k].Keyframe
+		positions[k] = c.Keyframes[k].Position
+		targets[k] = c.Keyframes[k].Target
+		fovs[k] = c.Keyframes[k].Fov
+	}
+	i, t := keySpan(keys, frame)
+	mode := keys[i].Interpolation
+	c.Position = interpolateVectors(positions, i, t, mode)
+	c.Target = interpolateVectors(targets, i, t, mode)
+	c.Fov = interpolateFloats(fovs, i, t, mode)
+	// Fov changes, projection has to be calculated again.
+	c.Projection = nil
+}
+
+func (l *Light) pose(frame float64) {
+	keys := make([]Keyframe, len(l.Keyframes))
+	positions := make([]Vector, len(l.Keyframes))
+	colors := make([]Vector, len(l.Keyframes))
+	directions := make([]Vector, len(l.Keyframes))
+	strengths := make([]float64, len(l.Keyframes))
+	for k := range l.Keyframes {
+		keys[k] = l.Keyframes[k].Keyframe
+		positions[k] = l.Keyframes[k].Position
+		colors[k] = l.Keyframes[k].Color
+		directions[k] = l.Keyframes[k].Direction
+		strengths[k] = l.Keyframes[k].LightStrength
+	}
+	i, t := keySpan(keys, frame)
+	mode := keys[i].Interpolation
+	l.Position = interpolateVectors(positions, i, t, mode)
+	l.Color = interpolateVectors(colors, i, t, mode)
+	l.Direction = normalizeVector(interpolateVectors(directions, i, t, mode))
+	l.LightStrength = interpolateFloats(strengths, i, t, mode)
+}
+
+// hasKeyframes tells if anything in the scene is animated.
+func (s *Scene) hasKeyframes() bool {
+	var animatedObjects func(objects map[string]*Object) bool
+	animatedObjects = func(objects map[string]*Object) bool {
+		for _, obj := range objects {
+			if len(obj.Keyframes) > 0 || animatedObjects(obj.Children) {
+				return true
+			}
+		}
+		return false
+	}
+	if animatedObjects(s.Objects) {
+		return true
+	}
+	for i := range s.Cameras {
+		if len(s.Cameras[i].Keyframes) > 0 {
+			return true
+		}
+	}
+	for i := range s.Lights {
+		if len(s.Lights[i].Keyframes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// poseCamerasAndLights sets animated camera and light values for the current frame.
+// Returns true if a light is animated.
+func (s *Scene) poseCamerasAndLights() bool {
+	start, end := s.shutterFrames()
+	for i := range s.Cameras {
+		if len(s.Cameras[i].Keyframes) > 0 {
+			s.Cameras[i].pose(s.frame)
+			s.Cameras[i].motion = s.Cameras[i].shutterMotion(start, end)
+		}
+	}
+	lightsAnimated := false
+	for i := range s.Lights {
+		if len(s.Lights[i].Keyframes) > 0 {
+			s.Lights[i].pose(s.frame)
+			lightsAnimated = true
+		}
+	}
+	return lightsAnimated
+}
+
+// poseObjects transforms objects that moved since they were last transformed.
+// Returns the number of moved objects.
+func (s *Scene) poseObjects() int {
+	moved := 0
+	for _, obj := range s.Objects {
+		if !obj.animated() {
+			continue
+		}
+		start, end := s.shutterMatrices(obj)
+		if start == obj.world && end == obj.worldEnd {
+			continue
+		}
+		obj.world, obj.worldEnd = start, end
+		obj.transformTriangles()
+		moved++
+	}
+	return moved
+}
+
+// setFrame poses the prepared scene for frame, cameras are set up again by useCamera.
+func (s *Scene) setFrame(ctx context.Context, frame int) error {
+	s.frame = float64(frame)
+	lightsAnimated := s.poseCamerasAndLights()
+	s.fixLightPos()
+	moved := s.poseObjects()
+	// Photons are stored on triangles, they have to be cast again when lights move.
+	rebuild := moved > 0 || (s.Config.RenderCaustics && lightsAnimated)
+	if rebuild {
+		s.mergeAll()
+		// Light objects may have moved, sample them again.
+		s.Lights = s.Lights[:s.sceneLightCount]
+		s.loadLights()
+	}
+	if s.Config.RenderCaustics && rebuild {
+		return s.buildPhotonMap(ctx)
+	}
+	return ctx.Err()
+}
@@ -1,33 +1,76 @@
 package raytracer
 
+/*
+Adaptive sampling. Every pixel keeps running sums of its sample
+luminance, so we can estimate how noisy the pixel still is and spend
+more samples only where they are needed (edges, soft shadows, glossy
+reflections...).
+*/
+
 import (
 	"math"
-	"math/rand"
 )
 
-func getPixel(scene *Scene, x, y int) Vector {
-	if GlobalConfig.AntialiasSamples > 64 {
-		GlobalConfig.AntialiasSamples = 64
-	}
-	if GlobalConfig.AntialiasSamples == 0 {
-		return scene.Pixels[x][y].Color
-	}
-	observer := scene.Cameras[0]
-	sw := scene.Width * 8
-	sh := scene.Height * 8
-	totalColor := Vector{}
-	totalHits := 0.0
-	p := rand.Perm(64)
-	for _, n := range p[:GlobalConfig.AntialiasSamples] {
-		yi := int(math.Floor(float64(n)/float64(8))) + (y * 8) - 4
-		xi := (n % 8) + (x * 8) - 4
-		rayDir := screenToWorld(xi, yi, sw, sh, observer.Position, *observer.Projection, observer.view)
-		hit := raycastSceneIntersect(scene, scene.Cameras[0].Position, rayDir)
-		render := hit.render(scene, 0)
-		totalColor = addVector(totalColor, render)
-		totalHits += 1.0
-	}
-	totalColor = scaleVector(totalColor, 1.0/totalHits)
-	totalColor[3] = 1
-	return totalColor
+// addSample accumulates a new sample into the pixel and updates its color estimate.
+func (p *PixelStorage) addSample(color Vector) {
+	for i := 0; i < 4; i++ {
+		p.Accumulated[i] += color[i]
+	}
+	lum := luminance(color)
+	p.LuminanceSum += lum
+	p.LuminanceSquares += lum * lum
+	p.Samples++
+	for i := 0; i < 4; i++ {
+		p.Color[i] = p.Accumulated[i] / float64(p.Samples)
+	}
+}
+
+// estimatedError is the standard error of the mean luminance relative to the mean.
+func (p *PixelStorage) estimatedError() float64 {
+	if p.Samples < 2 {
+		return math.Inf(1)
+	}
+	n := float64(p.Samples)
+	mean := p.LuminanceSum / n
+	variance := (p.LuminanceSquares - p.LuminanceSum*mean) / (n - 1)
+	if variance < 0 {
+		variance = 0
+	}
+	return math.Sqrt(variance/n) / math.Max(mean, 0.0001)
+}
+
+// converged tells if the pixel doesn't need any more samples. Progressive
+// renders are capped by their pass and time budgets instead of the adaptive
+// sample limit.
+func (p *PixelStorage) converged(config *Config) bool {
+	if p.Samples < config.AdaptiveMinSamples {
+		return false
+	}
+	if !config.Progressive && p.Samples >= config.AdaptiveMaxSamples {
+		return true
+	}
+	return p.estimatedError() <= config.AdaptiveThreshold
+}
+
+// samplePixel shoots a jittered camera ray through the pixel and accumulates the result.
+func samplePixel(scene *Scene, x, y int) {
+	sample := scene.pixelSample(x, y, scene.Pixels[x][y].Samples)
+	jx, jy := scene.cameraPoint(sample, dimensionPixel)
+	sx := float64(x+scene.Region.Left) + jx - 0.5
+	sy := float64(y+scene.Region.Top) + jy - 0.5
+	time := scene.rayTime(sample)
+	rayStart, rayDir, ok := scene.cameraRay(sx, sy, time, scene.lensPoint(sample))
+	hit := Intersection{}
+	if ok {
+		hit = raycastSceneIntersect(scene, rayStart, rayDir, time)
+	}
+	hit.sample = sample
+	scene.Pixels[x][y].addSample(hit.render(scene, 0, nil))
+}
+
+// refinePixel keeps sampling the pixel until it converges.
+func refinePixel(scene *Scene, x, y int) {
+	for !scene.Pixels[x][y].converged(&scene.Config) {
+		samplePixel(scene, x, y)
+	}
 }
@@ -0,0 +1,225 @@
+package raytracer
+
+/*
+Arbitrary output variables (render passes)
+*/
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Render pass names that can be requested with `render_passes` in config.
+const (
+	PassDepth      = "depth"
+	PassNormal     = "normal"
+	PassPosition   = "position"
+	PassAlbedo     = "albedo"
+	PassDirect     = "direct"
+	PassIndirect   = "indirect"
+	PassOcclusion  = "occlusion"
+	PassReflection = "reflection"
+	PassRefraction = "refraction"
+	PassObjectID   = "object_id"
+	PassMaterialID = "material_id"
+	PassUV         = "uv"
+	PassSamples    = "samples"
+)
+
+// RenderPasses lists every supported render pass in output order.
+var RenderPasses = []string{
+	PassDepth,
+	PassNormal,
+	PassPosition,
+	PassAlbedo,
+	PassDirect,
+	PassIndirect,
+	PassOcclusion,
+	PassReflection,
+	PassRefraction,
+	PassObjectID,
+	PassMaterialID,
+	PassUV,
+	PassSamples,
+}
+
+func isRenderPass(name string) bool {
+	for i := range RenderPasses {
+		if RenderPasses[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// passValue returns the raw (linear, unnormalized) value of the pass for given pixel.
+func passValue(pixel *PixelStorage, pass string) Vector {
+	if pass == PassSamples {
+		n := float64(pixel.Samples)
+		return Vector{n, n, n, 1}
+	}
+	if !pixel.WorldLocation.Hit {
+		return Vector{}
+	}
+	switch pass {
+	case PassDepth:
+		d := pixel.WorldLocation.Dist
+		return Vector{d, d, d, 1}
+	case PassNormal:
+		return Vector{pixel.Normal[0], pixel.Normal[1], pixel.Normal[2], 1}
+	case PassPosition:
+		return Vector{pixel.Position[0], pixel.Position[1], pixel.Position[2], 1}
+	case PassAlbedo:
+		return Vector{pixel.Albedo[0], pixel.Albedo[1], pixel.Albedo[2], 1}
+	case PassDirect:
+		return Vector{pixel.DirectLightEnergy[0], pixel.DirectLightEnergy[1], pixel.DirectLightEnergy[2], 1}
+	case PassIndirect:
+		return Vector{pixel.IndirectLight[0], pixel.IndirectLight[1], pixel.IndirectLight[2], 1}
+	case PassOcclusion:
+		return Vector{pixel.Occlusion, pixel.Occlusion, pixel.Occlusion, 1}
+	case PassReflection:
+		return Vector{pixel.Reflection[0], pixel.Reflection[1], pixel.Reflection[2], 1}
+	case PassRefraction:
+		return Vector{pixel.Refraction[0], pixel.Refraction[1], pixel.Refraction[2], 1}
+	case PassObjectID:
+		id := float64(pixel.ObjectID)
+		return Vector{id, id, id, 1}
+	case PassMaterialID:
+		id := float64(pixel.MaterialID)
+		return Vector{id, id, id, 1}
+	case PassUV:
+		return Vector{pixel.UV[0], pixel.UV[1], 0, 1}
+	}
+	return Vector{}
+}
+
+// idColor turns an ID into a distinct, stable color so IDs can be
+// picked visually in 8-bit images.
+func idColor(id int64) Vector {
+	if id == 0 {
+		return Vector{}
+	}
+	h := uint32(id) * 2654435761
+	return Vector{
+		float64(h>>24&0xff) / 255,
+		float64(h>>16&0xff) / 255,
+		float64(h>>8&0xff) / 255,
+		1,
+	}
+}
+
+// heatColor maps 0..1 onto a blue - green - yellow - red ramp.
+func heatColor(t float64) Vector {
+	ramp := []Vector{
+		{0, 0, 0.5, 1},
+		{0, 0.8, 0.2, 1},
+		{1, 1, 0, 1},
+		{1, 0, 0, 1},
+	}
+	t = math.Min(math.Max(t, 0), 1) * float64(len(ramp)-1)
+	i := int(math.Min(t, float64(len(ramp)-2)))
+	f := t - float64(i)
+	return Vector{
+		ramp[i][0]*(1-f) + ramp[i+1][0]*f,
+		ramp[i][1]*(1-f) + ramp[i+1][1]*f,
+		ramp[i][2]*(1-f) + ramp[i+1][2]*f,
+		1,
+	}
+}
+
+// passImage maps the pass onto 0..1 range so it can be stored as an 8-bit image.
+func passImage(scene *Scene, pass string) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, scene.Width, scene.Height))
+
+	// Depth and position are scene-scale values, find their range first.
+	maxDist := 0.0
+	maxSamples := 0
+	minPos := Vector{math.MaxFloat64, math.MaxFloat64, math.MaxFloat64, 0}
+	maxPos := Vector{-math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64, 0}
+	for i := 0; i < scene.Width; i++ {
+		for j := 0; j < scene.Height; j++ {
+			p := &scene.Pixels[i][j]
+			if p.Samples > maxSamples {
+				maxSamples = p.Samples
+			}
+			if !p.WorldLocation.Hit {
+				continue
+			}
+			maxDist = math.Max(maxDist, p.WorldLocation.Dist)
+			for k := 0; k < 3; k++ {
+				minPos[k] = math.Min(minPos[k], p.Position[k])
+				maxPos[k] = math.Max(maxPos[k], p.Position[k])
+			}
+		}
+	}
+
+	for i := 0; i < scene.Width; i++ {
+		for j := 0; j < scene.Height; j++ {
+			p := &scene.Pixels[i][j]
+			v := passValue(p, pass)
+			switch pass {
+			case PassDepth:
+				if maxDist > 0 {
+					v = Vector{v[0] / maxDist, v[1] / maxDist, v[2] / maxDist, v[3]}
+				}
+			case PassNormal:
+				v = Vector{v[0]*0.5 + 0.5, v[1]*0.5 + 0.5, v[2]*0.5 + 0.5, v[3]}
+			case PassPosition:
+				for k := 0; k < 3; k++ {
+					if maxPos[k] > minPos[k] {
+						v[k] = (v[k] - minPos[k]) / (maxPos[k] - minPos[k])
+					}
+				}
+			case PassObjectID:
+				v = idColor(p.ObjectID)
+			case PassMaterialID:
+				v = idColor(p.MaterialID)
+			case PassSamples:
+				v = heatColor(float64(p.Samples) / math.Max(float64(maxSamples), 1))
+			}
+			v = limitVector(v, 1.0)
+			img.Set(i, j, color.RGBA{
+				R: uint8(math.Floor(v[0] * 255)),
+				G: uint8(math.Floor(v[1] * 255)),
+				B: uint8(math.Floor(v[2] * 255)),
+				A: uint8(math.Floor(v[3] * 255)),
+			})
+		}
+	}
+	return img
+}
+
+// passFilename inserts the pass name before the extension: out.png -> out_depth.png.
+// Passes outside of EXR files are always 8-bit PNG images.
+func passFilename(filename, pass string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + pass + ".png"
+}
+
+func checkRenderPasses(passes []string) error {
+	for _, pass := range passes {
+		if !isRenderPass(pass) {
+			return fmt.Errorf("unknown render pass %s", pass)
+		}
+	}
+	return nil
+}
+
+// writeRenderPasses writes each requested render pass into its own file.
+func writeRenderPasses(scene *Scene, filename string) error {
+	if err := checkRenderPasses(scene.Config.RenderPasses); err != nil {
+		return err
+	}
+	for _, pass := range scene.Config.RenderPasses {
+		passFile := passFilename(filename, pass)
+		scene.logf("Writing %s pass to %s", pass, passFile)
+		if err := writePNG(passFile, passImage(scene, pass)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
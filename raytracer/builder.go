@@ -0,0 +1,417 @@
+package raytracer
+
+/*
+Scene builders for generating scenes from code instead of JSON files.
+Objects, lights and cameras are validated as they are added, so a built
+scene is ready for Render or a Renderer like a loaded one. Transforms
+apply in the order they are called, on top of the object matrix.
+*/
+
+import (
+	"fmt"
+	"math"
+)
+
+// defaultMaterial is the material name of meshes built from one material.
+const defaultMaterial = "material"
+
+// NewScene without any objects, lights or cameras.
+func NewScene(config Config) *Scene {
+	return &Scene{
+		Config:  config,
+		Objects: make(map[string]*Object),
+	}
+}
+
+// NewMesh builds an object from vertices and triangle indices, three per
+// triangle. Faces are shaded smooth with given normals, flat without them.
+func NewMesh(vertices, normals []Vector, indices []int, material Material) (*Object, error) {
+	o := &Object{
+		Vertices:  vertices,
+		Normals:   normals,
+		Matrix:    identityHmgMatrix,
+		Materials: make(map[string]Material),
+	}
+	if err := o.AddFaces(defaultMaterial, material, indices, normals != nil); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// AddFaces adds triangles of the material to the object, three indices each.
+func (o *Object) AddFaces(name string, material Material, indices []int, smooth bool) error {
+	if len(indices)%3 != 0 {
+		return fmt.Errorf("material %s has %d indices, triangles need three each", name, len(indices))
+	}
+	if err := material.validate(); err != nil {
+		return fmt.Errorf("material %s: %s", name, err.Error())
+	}
+	if o.Materials == nil {
+		o.Materials = make(map[string]Material)
+	}
+	if existing, ok := o.Materials[name]; ok {
+		material.Indices = existing.Indices
+	}
+	flag := int64(0)
+	if smooth {
+		flag = 1
+	}
+	for i := 0; i < len(indices); i += 3 {
+		face := indice{int64(indices[i]), int64(indices[i+1]), int64(indices[i+2]), flag}
+		for _, index := range face[:3] {
+			if index < 0 || index >= int64(len(o.Vertices)) {
+				return &MeshIndexError{Material: name, Kind: "vertex", Index: index, Count: len(o.Vertices)}
+			}
+		}
+		material.Indices = append(material.Indices, face)
+	}
+	o.Materials[name] = material
+	return nil
+}
+
+// validate material values that would break shading.
+func (m *Material) validate() error {
+	for i := 0; i < 4; i++ {
+		if m.Color[i] < 0 {
+			return fmt.Errorf("negative color %v", m.Color)
+		}
+	}
+	if m.Transmission < 0 || m.Transmission > 1 {
+		return fmt.Errorf("transmission %f is not in 0..1", m.Transmission)
+	}
+	if m.Glossiness < 0 || m.Glossiness > 1 {
+		return fmt.Errorf("glossiness %f is not in 0..1", m.Glossiness)
+	}
+	if m.Roughness < 0 || m.Roughness > 1 {
+		return fmt.Errorf("roughness %f is not in 0..1", m.Roughness)
+	}
+	if m.Transmission > 0 && m.IndexOfRefraction <= 0 {
+		return fmt.Errorf("transmission needs an index of refraction")
+	}
+	if m.Light && m.LightStrength <= 0 {
+		return fmt.Errorf("light material needs a light strength")
+	}
+	return nil
+}
+
+// faceNormals averages the normals of the faces around each vertex.
+func (o *Object) faceNormals() {
+	o.Normals = make([]Vector, len(o.Vertices))
+	for _, m := range o.Materials {
+		for _, face := range m.Indices {
+			p1, p2, p3 := o.Vertices[face[0]], o.Vertices[face[1]], o.Vertices[face[2]]
+			normal := crossProduct(subVector(p2, p1), subVector(p3, p1))
+			for _, index := range face[:3] {
+				o.Normals[index] = addVector(o.Normals[index], normal)
+			}
+		}
+	}
+	for i := range o.Normals {
+		o.Normals[i][3] = 0
+		o.Normals[i] = normalizeVector(o.Normals[i])
+	}
+}
+
+// Translate the object by offset.
+func (o *Object) Translate(offset Vector) *Object {
+	return o.transform(composeMatrix(offset, Vector{1, 1, 1, 0}, quaternion{0, 0, 0, 1}))
+}
+
+// Scale the object along the axes.
+func (o *Object) Scale(factors Vector) *Object {
+	return o.transform(composeMatrix(Vector{}, factors, quaternion{0, 0, 0, 1}))
+}
+
+// Rotate the object around axis, angle in degrees.
+func (o *Object) Rotate(axis Vector, degrees float64) *Object {
+	axis[3] = 0
+	axis = normalizeVector(axis)
+	half := degrees * math.Pi / 360
+	sin := math.Sin(half)
+	return o.transform(composeMatrix(Vector{}, Vector{1, 1, 1, 0}, quaternion{axis[0] * sin, axis[1] * sin, axis[2] * sin, math.Cos(half)}))
+}
+
+func (o *Object) transform(m Matrix) *Object {
+	if o.Matrix == (Matrix{}) {
+		o.Matrix = identityHmgMatrix
+	}
+	o.Matrix = multiplyMatrix(o.Matrix, m)
+	return o
+}
+
+// AddObject validates the object and adds it to the scene.
+func (s *Scene) AddObject(name string, o *Object) error {
+	if name == "" {
+		return fmt.Errorf("object needs a name")
+	}
+	if _, ok := s.Objects[name]; ok {
+		return fmt.Errorf("there is more than one object named %s", name)
+	}
+	if len(o.Vertices) == 0 {
+		return fmt.Errorf("object %s has no vertices", name)
+	}
+	if o.Matrix == (Matrix{}) {
+		o.Matrix = identityHmgMatrix
+	}
+	if len(o.Normals) == 0 {
+		o.faceNormals()
+	}
+	if err := o.checkIndices(name); err != nil {
+		return err
+	}
+	for m := range o.Materials {
+		mat := o.Materials[m]
+		if err := mat.validate(); err != nil {
+			return fmt.Errorf("object %s material %s: %s", name, m, err.Error())
+		}
+	}
+	o.fixW()
+	o.calcRadius()
+	storeLocalMatrices(map[string]*Object{name: o})
+	if s.Objects == nil {
+		s.Objects = make(map[string]*Object)
+	}
+	s.Objects[name] = o
+	if err := s.checkAdded(); err != nil {
+		delete(s.Objects, name)
+		return err
+	}
+	return nil
+}
+
+// NewPointLight shining from position.
+func NewPointLight(position, color Vector, strength float64) Light {
+	position[3] = 1
+	return Light{Position: position, Color: color, Active: true, LightStrength: strength}
+}
+
+// NewDirectionalLight shining along direction, like the sun.
+func NewDirectionalLight(direction, color Vector, strength float64) Light {
+	direction[3] = 0
+	return Light{Direction: direction, Color: color, Active: true, LightStrength: strength, Directional: true}
+}
+
+// AddLight validates the light and adds it to the scene.
+func (s *Scene) AddLight(light Light) error {
+	if light.LightStrength <= 0 {
+		return fmt.Errorf("light needs a light strength")
+	}
+	if light.Color[0] < 0 || light.Color[1] < 0 || light.Color[2] < 0 {
+		return fmt.Errorf("light has negative color %v", light.Color)
+	}
+	if light.Directional && vectorLength(light.Direction) < DIFF {
+		return fmt.Errorf("directional light needs a direction")
+	}
+	s.Lights = append(s.Lights, light)
+	if err := s.checkAdded(); err != nil {
+		s.Lights = s.Lights[:len(s.Lights)-1]
+		return err
+	}
+	return nil
+}
+
+// NewCamera looking from position at target with a vertical fov in degrees.
+func NewCamera(name string, position, target Vector, fov float64) Camera {
+	position[3] = 1
+	target[3] = 1
+	return Camera{
+		Name:     name,
+		Type:     CameraPerspective,
+		Position: position,
+		Target:   target,
+		Up:       Vector{0, 0, 1, 0},
+		Fov:      fov,
+		Near:     0.01,
+		Far:      10000,
+	}
+}
+
+// AddCamera validates the camera and adds it to the scene.
+func (s *Scene) AddCamera(camera Camera) error {
+	if vectorDistance(camera.Position, camera.Target) < DIFF {
+		return fmt.Errorf("camera %s looks at its own position", camera.Name)
+	}
+	if camera.Up == (Vector{}) {
+		camera.Up = Vector{0, 0, 1, 0}
+	}
+	if camera.Near <= 0 || camera.Far <= camera.Near {
+		return fmt.Errorf("camera %s has near %f and far %f clipping", camera.Name, camera.Near, camera.Far)
+	}
+	if camera.Type == CameraPerspective && (camera.Fov <= 0 || camera.Fov >= 180) {
+		return fmt.Errorf("camera %s has fov %f", camera.Name, camera.Fov)
+	}
+	s.Cameras = append(s.Cameras, camera)
+	if err := s.checkAdded(); err != nil {
+		s.Cameras = s.Cameras[:len(s.Cameras)-1]
+		return err
+	}
+	return nil
+}
+
+// checkAdded runs the checks of loaded scenes after something is added.
+func (s *Scene) checkAdded() error {
+	if err := s.checkCameras(); err != nil {
+		return err
+	}
+	if err := s.checkAnimation(); err != nil {
+		return err
+	}
+	s.animation = s.hasKeyframes()
+	return nil
+}
+
+// NewPlane of width along X and depth along Y, facing up.
+func NewPlane(width, depth float64, material Material) (*Object, error) {
+	w, d := width/2, depth/2
+	o, err := NewMesh([]Vector{
+		{-w, -d, 0, 1}, {w, -d, 0, 1}, {w, d, 0, 1}, {-w, d, 0, 1},
+	}, nil, []int{0, 1, 2, 0, 2, 3}, material)
+	if err != nil {
+		return nil, err
+	}
+	o.TexCoords = []Vector{{0, 0, 0, 0}, {1, 0, 0, 0}, {1, 1, 0, 0}, {0, 1, 0, 0}}
+	return o, nil
+}
+
+// NewBox centered on the origin, size is the length along each axis.
+func NewBox(size Vector, material Material) (*Object, error) {
+	x, y, z := size[0]/2, size[1]/2, size[2]/2
+	// Each side has its own corners so normals stay flat.
+	sides := [6][4]Vector{
+		{{-x, -y, -z}, {-x, y, -z}, {x, y, -z}, {x, -y, -z}},
+		{{-x, -y, z}, {x, -y, z}, {x, y, z}, {-x, y, z}},
+		{{-x, -y, -z}, {x, -y, -z}, {x, -y, z}, {-x, -y, z}},
+		{{x, y, -z}, {-x, y, -z}, {-x, y, z}, {x, y, z}},
+		{{-x, y, -z}, {-x, -y, -z}, {-x, -y, z}, {-x, y, z}},
+		{{x, -y, -z}, {x, y, -z}, {x, y, z}, {x, -y, z}},
+	}
+	vertices := make([]Vector, 0, 24)
+	texCoords := make([]Vector, 0, 24)
+	indices := make([]int, 0, 36)
+	for _, side := range sides {
+		base := len(vertices)
+		for i, corner := range side {
+			corner[3] = 1
+			vertices = append(vertices, corner)
+			texCoords = append(texCoords, Vector{float64((i + i/2) % 2), float64(i / 2), 0, 0})
+		}
+		indices = append(indices, base, base+1, base+2, base, base+2, base+3)
+	}
+	o, err := NewMesh(vertices, nil, indices, material)
+	if err != nil {
+		return nil, err
+	}
+	o.TexCoords = texCoords
+	return o, nil
+}
+
+// NewSphere centered on the origin, segments around and rings from pole to pole.
+func NewSphere(radius float64, segments, rings int, material Material) (*Object, error) {
+	if segments < 3 {
+		segments = 3
+	}
+	if rings < 2 {
+		rings = 2
+	}
+	vertices := make([]Vector, 0, (segments+1)*(rings+1))
+	normals := make([]Vector, 0, (segments+1)*(rings+1))
+	texCoords := make([]Vector, 0, (segments+1)*(rings+1))
+	for r := 0; r <= rings; r++ {
+		v := float64(r) / float64(rings)
+		theta := v * math.Pi
+		for sg := 0; sg <= segments; sg++ {
+			u := float64(sg) / float64(segments)
+			phi := u * 2 * math.Pi
+			normal := Vector{math.Sin(theta) * math.Cos(phi), math.Sin(theta) * math.Sin(phi), -math.Cos(theta), 0}
+			vertices = append(vertices, Vector{normal[0] * radius, normal[1] * radius, normal[2] * radius, 1})
+			normals = append(normals, normal)
+			texCoords = append(texCoords, Vector{u, v, 0, 0})
+		}
+	}
+	indices := make([]int, 0, segments*rings*6)
+	for r := 0; r < rings; r++ {
+		for sg := 0; sg < segments; sg++ {
+			a := r*(segments+1) + sg
+			b := a + segments + 1
+			// Pole rings would only add degenerate triangles.
+			if r > 0 {
+				indices = append(indices, a, a+1, b+1)
+			}
+			if r < rings-1 {
+				indices = append(indices, a, b+1, b)
+			}
+		}
+	}
+	o, err := NewMesh(vertices, normals, indices, material)
+	if err != nil {
+		return nil, err
+	}
+	o.TexCoords = texCoords
+	return o, nil
+}
+
+// NewCylinder standing on the Z axis centered on the origin, with closed caps.
+func NewCylinder(radius, height float64, segments int, material Material) (*Object, error) {
+	if segments < 3 {
+		segments = 3
+	}
+	h := height / 2
+	vertices := make([]Vector, 0)
+	normals := make([]Vector, 0)
+	texCoords := make([]Vector, 0)
+	for sg := 0; sg <= segments; sg++ {
+		u := float64(sg) / float64(segments)
+		phi := u * 2 * math.Pi
+		normal := Vector{math.Cos(phi), math.Sin(phi), 0, 0}
+		for _, z := range []float64{-h, h} {
+			vertices = append(vertices, Vector{normal[0] * radius, normal[1] * radius, z, 1})
+			normals = append(normals, normal)
+			texCoords = append(texCoords, Vector{u, (z + h) / height, 0, 0})
+		}
+	}
+	sides := make([]int, 0, segments*6)
+	for sg := 0; sg < segments; sg++ {
+		a := sg * 2
+		sides = append(sides, a, a+2, a+3, a, a+3, a+1)
+	}
+
+	// Caps get their own vertices, they are flat.
+	caps := make([]int, 0, segments*6)
+	for _, z := range []float64{-h, h} {
+		center := len(vertices)
+		up := Vector{0, 0, 1, 0}
+		if z < 0 {
+			up[2] = -1
+		}
+		vertices = append(vertices, Vector{0, 0, z, 1})
+		normals = append(normals, up)
+		texCoords = append(texCoords, Vector{0.5, 0.5, 0, 0})
+		for sg := 0; sg < segments; sg++ {
+			phi := float64(sg) / float64(segments) * 2 * math.Pi
+			vertices = append(vertices, Vector{math.Cos(phi) * radius, math.Sin(phi) * radius, z, 1})
+			normals = append(normals, up)
+			texCoords = append(texCoords, Vector{0.5 + math.Cos(phi)/2, 0.5 + math.Sin(phi)/2, 0, 0})
+		}
+		for sg := 0; sg < segments; sg++ {
+			a, b := center+1+sg, center+1+(sg+1)%segments
+			if z < 0 {
+				a, b = b, a
+			}
+			caps = append(caps, center, a, b)
+		}
+	}
+
+	o := &Object{
+		Vertices:  vertices,
+		Normals:   normals,
+		TexCoords: texCoords,
+		Matrix:    identityHmgMatrix,
+	}
+	if err := o.AddFaces(defaultMaterial, material, sides, true); err != nil {
+		return nil, err
+	}
+	if err := o.AddFaces(defaultMaterial, material, caps, false); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
@@ -0,0 +1,357 @@
+package raytracer
+
+/*
+Camera ray generation. Perspective cameras go through the projection
+matrix, orthographic cameras shoot parallel rays from a plane and
+panoramic cameras (equirectangular and equidistant fisheye) map pixels to
+angles around the view direction.
+
+Rays start from the pinhole camera position unless the camera has an
+aperture; then they start from a random point on the lens and pass
+through the point the pinhole ray hits on the focus plane, so only things
+at the focus distance stay sharp. Lens points are picked on a disk, or on
+a polygon with bokeh blades.
+*/
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Camera types.
+const (
+	CameraPerspective     = "perspective"
+	CameraOrthographic    = "orthographic"
+	CameraEquirectangular = "equirectangular"
+	CameraFisheye         = "fisheye"
+	CameraCubeMap         = "cubemap"
+)
+
+// sensorHeight of a 35mm full frame camera in millimeters.
+const sensorHeight = 24.0
+
+// checkCameras names cameras and validates their types. Cameras without a
+// type are perspective, unless older scenes turn the perspective flag off.
+func (s *Scene) checkCameras() error {
+	names := make(map[string]bool)
+	for i := range s.Cameras {
+		c := &s.Cameras[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("camera_%d", i+1)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("there is more than one camera named %s", c.Name)
+		}
+		names[c.Name] = true
+		switch c.Type {
+		case "":
+			c.Type = CameraPerspective
+			if c.Perspective != nil && !*c.Perspective {
+				c.Type = CameraOrthographic
+			}
+		case CameraPerspective, CameraOrthographic, CameraEquirectangular, CameraFisheye, CameraCubeMap:
+		default:
+			return fmt.Errorf("camera %s has unknown type %s", c.Name, c.Type)
+		}
+		if c.Type == CameraFisheye && c.Fov <= 0 {
+			c.Fov = 180
+		}
+		if err := checkCubeMap(c); err != nil {
+			return err
+		}
+		if err := checkStereo(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// camera is the camera currently rendering.
+func (s *Scene) camera() *Camera {
+	return &s.Cameras[s.cameraIndex]
+}
+
+// selectCameras returns the indexes of cameras to render, the first camera
+// unless there is a camera name or all cameras are asked for.
+func (s *Scene) selectCameras() ([]int, error) {
+	if len(s.Cameras) == 0 {
+		return nil, ErrNoCamera
+	}
+	if s.AllCameras {
+		cameras := make([]int, len(s.Cameras))
+		for i := range s.Cameras {
+			cameras[i] = i
+		}
+		return cameras, nil
+	}
+	if s.CameraName == "" {
+		return []int{0}, nil
+	}
+	for i := range s.Cameras {
+		if s.Cameras[i].Name == s.CameraName {
+			return []int{i}, nil
+		}
+	}
+	return nil, &CameraNotFoundError{Name: s.CameraName}
+}
+
+// useCamera sets up the prepared scene to render a width x height frame through camera index.
+func (s *Scene) useCamera(index, width, height int) {
+	s.cameraIndex = index
+	s.frameWidth = width
+	s.frameHeight = height
+	s.prepareMatrices()
+}
+
+// cameraFilename adds the camera name to filename.
+func cameraFilename(filename, camera string) string {
+	if filename == "" {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + camera + ext
+}
+
+// frameSize adjusts the requested frame size to the camera layout.
+func (c *Camera) frameSize(width, height int) (int, int) {
+	if c.Type == CameraCubeMap {
+		return c.cubeFrameSize(width, height)
+	}
+	return c.stereoFrameSize(width, height)
+}
+
+// cameraFrameSize is frameSize of the camera, noting when it differs from the asked size.
+func (s *Scene) cameraFrameSize(index, width, height int) (int, int) {
+	c := &s.Cameras[index]
+	w, h := c.frameSize(width, height)
+	if w != width || h != height {
+		s.logf("Camera %s frame is %dx%d", c.Name, w, h)
+	}
+	return w, h
+}
+
+// viewSize is the size of a single view in the frame, an eye or a cube face.
+func (c *Camera) viewSize(width, height int) (int, int) {
+	if c.Type == CameraCubeMap {
+		columns, rows := c.cubeGrid()
+		return width / columns, height / rows
+	}
+	return c.eyeSize(width, height)
+}
+
+// prepareProjection sets the stereo convergence and the orthographic view
+// size, from the field of view at the target distance if there is no ortho scale.
+func (c *Camera) prepareProjection() {
+	c.convergence = c.ConvergenceDistance
+	if c.convergence <= 0 {
+		c.convergence = vectorDistance(c.Target, c.Position)
+	}
+	if c.Type != CameraOrthographic {
+		return
+	}
+	aspect := float64(c.width) / float64(c.height)
+	scale := c.OrthoScale
+	if scale <= 0 {
+		scale = 2 * vectorDistance(c.Target, c.Position) * math.Tan(c.Fov*math.Pi/360) * math.Max(aspect, 1)
+	}
+	if aspect >= 1 {
+		c.orthoWidth, c.orthoHeight = scale, scale/aspect
+	} else {
+		c.orthoWidth, c.orthoHeight = scale*aspect, scale
+	}
+}
+
+// viewAxes returns the side, up and forward directions of a view matrix.
+func viewAxes(view Matrix) (Vector, Vector, Vector) {
+	side := Vector{view[0][0], view[1][0], view[2][0], 0}
+	up := Vector{view[0][1], view[1][1], view[2][1], 0}
+	forward := Vector{-view[0][2], -view[1][2], -view[2][2], 0}
+	return side, up, forward
+}
+
+// cameraRay returns the start and direction of the camera ray through frame
+// coordinates x, y at shutter time. False if there is no ray for the pixel,
+// like the corners of a fisheye image.
+func (s *Scene) cameraRay(x, y, time float64, lens [2]float64) (Vector, Vector, bool) {
+	c := s.camera()
+	position, view, projection := c.Position, c.view, *c.Projection
+	if c.motion != nil {
+		position, view, projection = c.motion.at(c, time)
+	}
+	x, y, eye := c.eyeCoordinates(x, y)
+	face := 0
+	if c.Type == CameraCubeMap {
+		x, y, face = c.cubeFace(x, y)
+	}
+	// View coordinates in -1..1, y up.
+	u := 2*x/float64(c.width) - 1
+	v := 1 - 2*y/float64(c.height)
+	rayStart, rayDir := position, Vector{}
+	switch c.Type {
+	case CameraOrthographic:
+		rayStart, rayDir = orthographicRay(u, v, c.orthoWidth, c.orthoHeight, position, view)
+	case CameraEquirectangular:
+		rayDir = equirectangularRay(u, v, view)
+	case CameraFisheye:
+		aspect := float64(c.width) / float64(c.height)
+		var ok bool
+		if rayDir, ok = fisheyeRay(u*aspect, v, c.Fov, view); !ok {
+			return rayStart, rayDir, false
+		}
+	case CameraCubeMap:
+		rayDir = cubeFaceRay(u, v, face, view)
+	default:
+		rayDir = screenToWorld(x, y, c.width, c.height, position, projection, view)
+	}
+	if eye != 0 {
+		rayStart, rayDir = c.stereoEye(eye, rayStart, rayDir, view)
+	}
+	if c.lensRadius > 0 {
+		rayStart, rayDir = c.thinLens(lens, rayStart, view, rayDir)
+	}
+	return rayStart, rayDir, true
+}
+
+// orthographicRay shoots parallel to the view direction from the view plane.
+func orthographicRay(u, v, width, height float64, position Vector, view Matrix) (Vector, Vector) {
+	side, up, forward := viewAxes(view)
+	rayStart := addVector(position, combine(side, up, u*width/2, v*height/2))
+	rayStart[3] = 1
+	return rayStart, forward
+}
+
+// equirectangularRay maps u to longitude and v to latitude around the view direction.
+func equirectangularRay(u, v float64, view Matrix) Vector {
+	side, up, forward := viewAxes(view)
+	longitude := u * math.Pi
+	latitude := v * math.Pi / 2
+	horizontal := combine(forward, side, math.Cos(longitude), math.Sin(longitude))
+	return normalizeVector(combine(horizontal, up, math.Cos(latitude), math.Sin(latitude)))
+}
+
+// fisheyeRay is the equidistant fisheye mapping, the angle from the view
+// direction grows linearly with the distance from the image center.
+// The fov circle fits the frame height.
+func fisheyeRay(u, v, fov float64, view Matrix) (Vector, bool) {
+	r := math.Sqrt(u*u + v*v)
+	if r > 1 {
+		return Vector{}, false
+	}
+	side, up, forward := viewAxes(view)
+	theta := r * fov * math.Pi / 360
+	phi := math.Atan2(v, u)
+	around := combine(side, up, math.Cos(phi), math.Sin(phi))
+	return normalizeVector(combine(forward, around, math.Cos(theta), math.Sin(theta))), true
+}
+
+// thinLens moves the ray start onto the lens, keeping the focus plane point.
+func (c *Camera) thinLens(lens [2]float64, position Vector, view Matrix, rayDir Vector) (Vector, Vector) {
+	side, up, forward := viewAxes(view)
+	focus := addVector(position, scaleVector(rayDir, c.focusDistance/dot(rayDir, forward)))
+	u, v := sampleLens(lens[0], lens[1], c.BokehBlades, c.BokehRotation)
+	start := addVector(position, combine(side, up, u*c.lensRadius, v*c.lensRadius))
+	start[3] = 1
+	return start, normalizeVector(subVector(focus, start))
+}
+
+// sampleLens maps the point of the unit square onto the unit disk, or onto
+// the unit polygon with blades corners.
+func sampleLens(a, b float64, blades int, rotation float64) (float64, float64) {
+	if blades < 3 {
+		// Concentric mapping keeps the samples evenly spread.
+		a, b = 2*a-1, 2*b-1
+		if a == 0 && b == 0 {
+			return 0, 0
+		}
+		var r, theta float64
+		if math.Abs(a) > math.Abs(b) {
+			r, theta = a, math.Pi/4*(b/a)
+		} else {
+			r, theta = b, math.Pi/2-math.Pi/4*(a/b)
+		}
+		return r * math.Cos(theta), r * math.Sin(theta)
+	}
+	// Polygon slices have the same area, pick one and a point in its triangle.
+	step := 2 * math.Pi / float64(blades)
+	// The first coordinate picks the slice and is reused within it.
+	blade := math.Min(math.Floor(a*float64(blades)), float64(blades-1))
+	a = a*float64(blades) - blade
+	start := blade*step + rotation*math.Pi/180
+	if a+b > 1 {
+		a, b = 1-a, 1-b
+	}
+	x := a*math.Cos(start) + b*math.Cos(start+step)
+	y := a*math.Sin(start) + b*math.Sin(start+step)
+	return x, y
+}
+
+// focalLength in millimeters, from the field of view if not set.
+func (c *Camera) focalLength() float64 {
+	if c.FocalLength > 0 {
+		return c.FocalLength
+	}
+	return sensorHeight / 2 / math.Tan(c.Fov*math.Pi/360)
+}
+
+// focus sets the lens radius and focus distance of the camera.
+func (s *Scene) focus(c *Camera) {
+	c.lensRadius = c.Aperture
+	if c.lensRadius <= 0 && c.FStop > 0 {
+		c.lensRadius = c.focalLength() / c.FStop / 2 / 1000
+	}
+	if c.lensRadius <= 0 {
+		return
+	}
+	if c.Type == CameraEquirectangular || c.Type == CameraFisheye || c.Type == CameraCubeMap {
+		s.logf("Depth of field is not supported with %s cameras", c.Type)
+		c.lensRadius = 0
+		return
+	}
+	// Focus object comes first, then focus point, focus distance and the camera target.
+	target := c.Target
+	switch {
+	case c.FocusObject != "":
+		center, ok := s.objectCenter(c.FocusObject)
+		if ok {
+			target = center
+		} else {
+			s.logf("Focus object %s not found, focusing on the camera target", c.FocusObject)
+		}
+	case c.FocusPoint != nil:
+		target = *c.FocusPoint
+	case c.FocusDistance > 0:
+		c.focusDistance = c.FocusDistance
+		return
+	}
+	// Focus plane is perpendicular to the view direction.
+	forward := normalizeVector(subVector(c.Target, c.Position))
+	c.focusDistance = dot(subVector(target, c.Position), forward)
+	if c.focusDistance <= 0 {
+		s.logf("Focus is behind the camera, depth of field disabled")
+		c.lensRadius = 0
+	}
+}
+
+// objectCenter is the center of the object bounds in world space.
+func (s *Scene) objectCenter(name string) (Vector, bool) {
+	id, ok := s.objectIDs[name]
+	if !ok || s.MasterObject == nil {
+		return Vector{}, false
+	}
+	points := make([]Vector, 0)
+	for i := range s.MasterObject.Triangles {
+		t := &s.MasterObject.Triangles[i]
+		if t.objectID == id {
+			points = append(points, t.P1, t.P2, t.P3)
+		}
+	}
+	if len(points) == 0 {
+		return Vector{}, false
+	}
+	min, max := calculateBounds(points)
+	center := scaleVector(addVector(min, max), 0.5)
+	center[3] = 1
+	return center, true
+}
@@ -0,0 +1,238 @@
+package raytracer
+
+/*
+Checkpoints keep accumulated pixel data on disk while rendering so a
+crashed or stopped render can be resumed instead of started over.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// storedPixel is the part of PixelStorage that can be saved and restored,
+// used by checkpoints and distributed rendering. Intersections are
+// recalculated by scanning the view again.
+type storedPixel struct {
+	X                 int
+	Y                 int
+	Hit               bool
+	Accumulated       Vector
+	LuminanceSum      float64
+	LuminanceSquares  float64
+	Samples           int
+	DirectLightEnergy Vector
+	IndirectLight     Vector
+	AmbientColor      Vector
+	Albedo            Vector
+	Normal            Vector
+	Position          Vector
+	Reflection        Vector
+	Refraction        Vector
+	UV                Vector
+	Occlusion         float64
+	Depth             float64
+	ObjectID          int64
+	MaterialID        int64
+}
+
+func (p *PixelStorage) store(x, y int) storedPixel {
+	return storedPixel{
+		X:                 x,
+		Y:                 y,
+		Hit:               p.WorldLocation.Hit,
+		Accumulated:       p.Accumulated,
+		LuminanceSum:      p.LuminanceSum,
+		LuminanceSquares:  p.LuminanceSquares,
+		Samples:           p.Samples,
+		DirectLightEnergy: p.DirectLightEnergy,
+		IndirectLight:     p.IndirectLight,
+		AmbientColor:      p.AmbientColor,
+		Albedo:            p.Albedo,
+		Normal:            p.Normal,
+		Position:          p.Position,
+		Reflection:        p.Reflection,
+		Refraction:        p.Refraction,
+		UV:                p.UV,
+		Occlusion:         p.Occlusion,
+		Depth:             p.Depth,
+		ObjectID:          p.ObjectID,
+		MaterialID:        p.MaterialID,
+	}
+}
+
+func (p *PixelStorage) restore(sp *storedPixel) {
+	p.X = sp.X
+	p.Y = sp.Y
+	p.Accumulated = sp.Accumulated
+	p.LuminanceSum = sp.LuminanceSum
+	p.LuminanceSquares = sp.LuminanceSquares
+	p.Samples = sp.Samples
+	p.DirectLightEnergy = sp.DirectLightEnergy
+	p.IndirectLight = sp.IndirectLight
+	p.AmbientColor = sp.AmbientColor
+	p.Albedo = sp.Albedo
+	p.Normal = sp.Normal
+	p.Position = sp.Position
+	p.Reflection = sp.Reflection
+	p.Refraction = sp.Refraction
+	p.UV = sp.UV
+	p.Occlusion = sp.Occlusion
+	p.Depth = sp.Depth
+	p.ObjectID = sp.ObjectID
+	p.MaterialID = sp.MaterialID
+	if p.Samples > 0 {
+		for k := 0; k < 4; k++ {
+			p.Color[k] = p.Accumulated[k] / float64(p.Samples)
+		}
+	}
+}
+
+type checkpoint struct {
+	ConfigHash string
+	SceneHash  string
+	Width      int
+	Height     int
+	Region     Region
+	Pass       int
+	Pixels     []storedPixel
+}
+
+// checkpointer saves checkpoints at the configured interval.
+type checkpointer struct {
+	filename string
+	interval time.Duration
+	last     time.Time
+	pass     int
+}
+
+// renderConfigHash hashes configuration values that change the rendered pixels.
+// Budgets and post-processing can change between resumes.
+func renderConfigHash(config Config) string {
+	config.AdaptiveMaxSamples = 0
+	config.AutoExposure = ""
+	config.CheckpointInterval = 0
+	config.Denoise = false
+	config.DenoiseRadius = 0
+	config.DenoiseStrength = 0
+	config.DisplayExposure = 0
+	config.EXRCompression = ""
+	config.EXRPixelType = ""
+	config.ExposureStops = 0
+	config.Percentage = 0
+	config.PreviewInterval = 0
+	config.PreviewPasses = 0
+	config.ProgressivePasses = 0
+	config.ProgressiveTime = 0
+	config.RenderPasses = nil
+	config.SRGBOutput = false
+	config.ToneMapping = ""
+	config.WhiteBalance = 0
+	data, _ := json.Marshal(config)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newCheckpointer(config *Config, filename string) *checkpointer {
+	return &checkpointer{
+		filename: filename,
+		interval: time.Duration(config.CheckpointInterval * float64(time.Second)),
+		last:     time.Now(),
+	}
+}
+
+// maybeSave writes a checkpoint if the interval passed since the last one.
+func (c *checkpointer) maybeSave(scene *Scene) {
+	if c.interval <= 0 || time.Since(c.last) < c.interval {
+		return
+	}
+	if err := c.save(scene); err != nil {
+		scene.logf("Error writing checkpoint %s: %s", c.filename, err.Error())
+	}
+	c.last = time.Now()
+}
+
+func (c *checkpointer) save(scene *Scene) error {
+	cp := checkpoint{
+		ConfigHash: renderConfigHash(scene.Config),
+		SceneHash:  scene.sceneHash,
+		Width:      scene.frameWidth,
+		Height:     scene.frameHeight,
+		Region:     scene.Region,
+		Pass:       c.pass,
+		Pixels:     make([]storedPixel, 0),
+	}
+	for i := 0; i < scene.Width; i++ {
+		for j := 0; j < scene.Height; j++ {
+			p := &scene.Pixels[i][j]
+			if p.Samples == 0 {
+				continue
+			}
+			cp.Pixels = append(cp.Pixels, p.store(i, j))
+		}
+	}
+
+	// Write to a temporary file first, so a crash while writing
+	// doesn't destroy the previous checkpoint.
+	tmp := c.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&cp)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	if cerr != nil {
+		return cerr
+	}
+	if err := os.Rename(tmp, c.filename); err != nil {
+		return err
+	}
+	scene.logf("Checkpoint saved to %s with %d pixels", c.filename, len(cp.Pixels))
+	return nil
+}
+
+// restore loads the checkpoint into scene pixels. Scene must be prepared.
+func (c *checkpointer) restore(scene *Scene) error {
+	f, err := os.Open(c.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var cp checkpoint
+	if err := gob.NewDecoder(f).Decode(&cp); err != nil {
+		return fmt.Errorf("can't read checkpoint %s: %s", c.filename, err.Error())
+	}
+	if cp.SceneHash != scene.sceneHash {
+		return fmt.Errorf("checkpoint %s was created for a different scene", c.filename)
+	}
+	if cp.ConfigHash != renderConfigHash(scene.Config) {
+		return fmt.Errorf("checkpoint %s was created with a different configuration", c.filename)
+	}
+	if cp.Width != scene.frameWidth || cp.Height != scene.frameHeight {
+		return fmt.Errorf("checkpoint %s is %dx%d, render is %dx%d", c.filename, cp.Width, cp.Height, scene.frameWidth, scene.frameHeight)
+	}
+	if cp.Region != scene.Region {
+		return fmt.Errorf("checkpoint %s is for region %s, render is %s", c.filename, cp.Region, scene.Region)
+	}
+	for i := range cp.Pixels {
+		scene.Pixels[cp.Pixels[i].X][cp.Pixels[i].Y].restore(&cp.Pixels[i])
+	}
+	c.pass = cp.Pass
+	scene.logf("Resumed %d pixels from checkpoint %s at pass %d", len(cp.Pixels), c.filename, cp.Pass)
+	return nil
+}
+
+// remove the checkpoint once the render is complete.
+func (c *checkpointer) remove(scene *Scene) {
+	if err := os.Remove(c.filename); err != nil && !os.IsNotExist(err) {
+		scene.logf("Can't remove checkpoint %s: %s", c.filename, err.Error())
+	}
+}
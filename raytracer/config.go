@@ -2,36 +2,60 @@ package raytracer
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 )
 
 // Config keeps Raytracer Configuration.
 type Config struct {
-	AmbientColorSharingRatio float64 `json:"ambient_color_ratio"`
-	AmbientRadius            float64 `json:"ambient_occlusion_radius"`
-	AntialiasSamples         int     `json:"antialias_samples"`
-	CausticsSamplerLimit     int     `json:"caustics_samples"`
-	EdgeDetechThreshold      float64 `json:"edge_detect_threshold"`
-	EnvironmentMap           string  `json:"environment_map"`
-	Exposure                 float64 `json:"exposure"`
-	Height                   int     `json:"height"`
-	LightSampleCount         int     `json:"light_sample_count"`
-	MaxReflectionDepth       int     `json:"max_reflection_depth"`
-	OcclusionRate            float64 `json:"occlusion_rate"`
-	PhotonSpacing            float64 `json:"photon_spacing"`
-	RayCorrection            float64 `json:"ray_correction"`
-	RenderAmbientColors      bool    `json:"render_ambient_color"`
-	RenderBumpMap            bool    `json:"render_bump_map"`
-	RenderCaustics           bool    `json:"render_caustics"`
-	RenderColors             bool    `json:"render_colors"`
-	RenderLights             bool    `json:"render_lights"`
-	RenderOcclusion          bool    `json:"render_occlusion"`
-	RenderReflections        bool    `json:"render_reflections"`
-	RenderRefractions        bool    `json:"render_refractions"`
-	SamplerLimit             int     `json:"sampler_limit"`
-	TransparentColor         Vector  `json:"transparent_color"`
-	Width                    int     `json:"width"`
+	AdaptiveMaxSamples       int      `json:"adaptive_max_samples"`
+	AdaptiveMinSamples       int      `json:"adaptive_min_samples"`
+	AdaptiveThreshold        float64  `json:"adaptive_threshold"`
+	AmbientColorSharingRatio float64  `json:"ambient_color_ratio"`
+	AmbientRadius            float64  `json:"ambient_occlusion_radius"`
+	AutoExposure             string   `json:"auto_exposure"`
+	CausticsSamplerLimit     int      `json:"caustics_samples"`
+	CheckpointInterval       float64  `json:"checkpoint_interval"`
+	Denoise                  bool     `json:"denoise"`
+	DenoiseRadius            int      `json:"denoise_radius"`
+	DenoiseStrength          float64  `json:"denoise_strength"`
+	DisplayExposure          float64  `json:"display_exposure"`
+	EnvironmentMap           string   `json:"environment_map"`
+	EXRCompression           string   `json:"exr_compression"`
+	EXRPixelType             string   `json:"exr_pixel_type"`
+	Exposure                 float64  `json:"exposure"`
+	ExposureStops            float64  `json:"exposure_stops"`
+	Height                   int      `json:"height"`
+	HemisphereSampling       string   `json:"hemisphere_sampling"`
+	LightSampleCount         int      `json:"light_sample_count"`
+	MaxReflectionDepth       int      `json:"max_reflection_depth"`
+	MotionBlur               bool     `json:"motion_blur"`
+	OcclusionRate            float64  `json:"occlusion_rate"`
+	PhotonSpacing            float64  `json:"photon_spacing"`
+	PreviewInterval          float64  `json:"preview_interval"`
+	PreviewPasses            int      `json:"preview_passes"`
+	Progressive              bool     `json:"progressive"`
+	ProgressivePasses        int      `json:"progressive_passes"`
+	ProgressiveTime          float64  `json:"progressive_time"`
+	RayCorrection            float64  `json:"ray_correction"`
+	RenderAmbientColors      bool     `json:"render_ambient_color"`
+	RenderBumpMap            bool     `json:"render_bump_map"`
+	RenderCaustics           bool     `json:"render_caustics"`
+	RenderColors             bool     `json:"render_colors"`
+	RenderLights             bool     `json:"render_lights"`
+	RenderOcclusion          bool     `json:"render_occlusion"`
+	RenderReflections        bool     `json:"render_reflections"`
+	RenderRefractions        bool     `json:"render_refractions"`
+	RenderPasses             []string `json:"render_passes"`
+	Sampler                  string   `json:"sampler"`
+	SamplerLimit             int      `json:"sampler_limit"`
+	Seed                     int64    `json:"seed"`
+	Shutter                  float64  `json:"shutter"`
+	SRGBOutput               bool     `json:"srgb_output"`
+	ToneMapping              string   `json:"tone_mapping"`
+	TransparentColor         Vector   `json:"transparent_color"`
+	WhiteBalance             float64  `json:"white_balance"`
+	Width                    int      `json:"width"`
 	Percentage               int
 }
 
@@ -39,19 +63,36 @@ type Config struct {
 // These are likely incorrect :D.
 var DEFAULT = Config{
 	// Default Config Settings
+	AdaptiveMaxSamples:       64,
+	AdaptiveMinSamples:       4,
+	AdaptiveThreshold:        0.05,
 	AmbientColorSharingRatio: 0.5,
 	AmbientRadius:            2.1,
-	AntialiasSamples:         8,
+	AutoExposure:             "",
 	CausticsSamplerLimit:     10000,
+	CheckpointInterval:       300,
+	Denoise:                  false,
+	DenoiseRadius:            4,
+	DenoiseStrength:          0.5,
+	DisplayExposure:          1,
 	EnvironmentMap:           "",
-	EdgeDetechThreshold:      0.7,
+	EXRCompression:           "zip",
+	EXRPixelType:             "half",
 	Exposure:                 0.2,
+	ExposureStops:            0,
 	Height:                   900,
+	HemisphereSampling:       HemisphereCosine,
 	LightSampleCount:         16,
 	MaxReflectionDepth:       3,
+	MotionBlur:               false,
 	OcclusionRate:            0.2,
 	Percentage:               100,
 	PhotonSpacing:            0.005,
+	PreviewInterval:          60,
+	PreviewPasses:            0,
+	Progressive:              false,
+	ProgressivePasses:        defaultProgressivePasses,
+	ProgressiveTime:          0,
 	RayCorrection:            0.002,
 	RenderAmbientColors:      true,
 	RenderBumpMap:            true,
@@ -61,43 +102,35 @@ var DEFAULT = Config{
 	RenderOcclusion:          true,
 	RenderReflections:        true,
 	RenderRefractions:        true,
+	RenderPasses:             []string{},
+	Sampler:                  SamplerSobol,
 	SamplerLimit:             16,
+	Seed:                     0,
+	Shutter:                  0.5,
+	SRGBOutput:               true,
+	ToneMapping:              ToneMapClamp,
 	TransparentColor:         Vector{0, 0, 0, 0},
+	WhiteBalance:             neutralWhiteBalance,
 	Width:                    1600,
 }
 
-// GlobalConfig is reachable from all app context
-// I know that Globals are evil but believe me it's better to have it in global
-// in this application.
-var GlobalConfig = Config{}
-
 // LoadConfig file for the render.
-func loadConfig(jsonFile string) error {
-	var config Config
-	log.Printf("Loading configuration from %s", jsonFile)
+func LoadConfig(jsonFile string) (Config, error) {
+	// Start from defaults so options missing in older config files stay sane.
+	config := DEFAULT
 	file, err := ioutil.ReadFile(jsonFile)
 	if err != nil {
-		log.Printf("Error while reading file: %s", err.Error())
-		return nil
+		return config, fmt.Errorf("can't read config %s: %w", jsonFile, err)
 	}
-	log.Printf("Unmarshal JSON\n")
 	err = json.Unmarshal(file, &config)
 	if err != nil {
-		log.Fatalf("Error unmarshalling %s", err.Error())
-		return err
+		return config, fmt.Errorf("can't parse config %s: %w", jsonFile, err)
 	}
-	GlobalConfig = config
-	return nil
+	return config, nil
 }
 
 // CreateConfig file.
 func CreateConfig(jsonfile string) error {
 	file, _ := json.MarshalIndent(DEFAULT, "", " ")
-	ferr := ioutil.WriteFile(jsonfile, file, 0600)
-	if ferr != nil {
-		log.Fatal(ferr.Error())
-		return ferr
-	}
-	log.Printf("Created config.json")
-	return nil
+	return ioutil.WriteFile(jsonfile, file, 0600)
 }
@@ -1,25 +1,19 @@
 package raytracer
 
 import (
-	"image"
-	"image/png"
-	"log"
-	"math"
-	"math/rand"
+	"context"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/cheggaaa/pb"
 )
 
-func getWidthHeight(size string) (int, int, error) {
+func getWidthHeight(scene *Scene, size string) (int, int, error) {
 	var err error
-	width := GlobalConfig.Width
-	height := GlobalConfig.Height
+	width := scene.Config.Width
+	height := scene.Config.Height
 	if strings.Contains(size, "x") {
-		log.Printf("Set size to %s", size)
+		scene.logf("Set size to %s", size)
 		split := strings.Split(size, "x")
 		width, err = strconv.Atoi(split[0])
 		if err != nil {
@@ -33,21 +27,16 @@ func getWidthHeight(size string) (int, int, error) {
 	return width, height, nil
 }
 
-func getPixelList(width, height, left, right, top, bottom, percent int) (int, []int) {
-	actualWidth := width
-	actualHeight := height
-	if right+left > 0 {
-		actualWidth = right - left
-		actualHeight = bottom - top
-	}
-
-	totalPixels := actualWidth * actualHeight
+// getPixelList returns shuffled pixel indices of a width x height region,
+// only percent of them if the render is partial.
+func getPixelList(rnd *randomStream, width, height, percent int) (int, []int) {
+	totalPixels := width * height
 
 	pixelList := make([]int, totalPixels)
 	for i := 0; i < totalPixels; i++ {
 		pixelList[i] = i
 	}
-	rand.Shuffle(totalPixels, func(i, j int) { pixelList[i], pixelList[j] = pixelList[j], pixelList[i] })
+	rnd.shuffle(totalPixels, func(i, j int) { pixelList[i], pixelList[j] = pixelList[j], pixelList[i] })
 
 	to := percent * totalPixels / 100
 	if percent < 100 {
@@ -57,43 +46,198 @@ func getPixelList(width, height, left, right, top, bottom, percent int) (int, []
 	return totalPixels, pixelList
 }
 
-// Render the scene, main processor.
-func Render(scene *Scene, left, right, top, bottom, percent int, size *string) error {
-	width, height, err := getWidthHeight(*size)
+// Render the scene, main processor. Each region is rendered into its own
+// output, the whole frame is rendered if no region is given. Rendering
+// stops when ctx is done.
+func Render(ctx context.Context, scene *Scene, regions []Region, percent int, size *string) error {
+	width, height, err := getWidthHeight(scene, *size)
 	if err != nil {
 		return err
 	}
+	cameras, err := scene.selectCameras()
+	if err != nil {
+		return err
+	}
+	if len(regions) == 0 {
+		regions = []Region{{}}
+	}
+	// Camera layouts can change the frame size, regions are fit for each camera.
+	cameraRegions := make([][]Region, len(cameras))
+	for c, index := range cameras {
+		w, h := scene.cameraFrameSize(index, width, height)
+		cameraRegions[c] = make([]Region, len(regions))
+		for i := range regions {
+			cameraRegions[c][i], err = regions[i].fit(w, h)
+			if err != nil {
+				return err
+			}
+			if err := scene.checkRegionExposure(cameraRegions[c][i], w, h); err != nil {
+				return err
+			}
+		}
+	}
 
-	log.Printf("Start rendering scene\n")
-	scene.prepare(width, height)
-	start := time.Now()
+	scene.logf("Start rendering scene\n")
+	// Geometry and textures are prepared once, frames only move things
+	// around and cameras only need their own matrices.
+	renderCameras := func(name func(filename string) string) error {
+		for c, index := range cameras {
+			camera := scene.Cameras[index].Name
+			w, h := scene.Cameras[index].frameSize(width, height)
+			scene.useCamera(index, w, h)
+			cameraName := name
+			if len(cameras) > 1 {
+				scene.logf("Rendering camera %s", camera)
+				cameraName = func(filename string) string {
+					return name(cameraFilename(filename, camera))
+				}
+			}
+			if err := renderFrame(ctx, scene, cameraRegions[c], percent, cameraName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(scene.Frames) == 0 {
+		if err := scene.prepare(ctx); err != nil {
+			return err
+		}
+		return renderCameras(func(filename string) string {
+			return filename
+		})
+	}
 
-	upLeft := image.Point{X: 0, Y: 0}
-	log.Printf("Initial rendering: %d x %d\n", width, height)
-	lowRight := image.Point{X: width, Y: height}
+	scene.frame = float64(scene.Frames[0])
+	if err := scene.prepare(ctx); err != nil {
+		return err
+	}
+	for _, frame := range scene.Frames {
+		frame := frame
+		scene.logf("Rendering frame %d", frame)
+		if err := scene.setFrame(ctx, frame); err != nil {
+			return err
+		}
+		err = renderCameras(func(filename string) string {
+			return frameFilename(filename, frame)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	img := image.NewRGBA(image.Rectangle{Min: upLeft, Max: lowRight})
+// renderFrame renders regions of the posed scene. name gives the frame's
+// version of output filenames.
+func renderFrame(ctx context.Context, scene *Scene, regions []Region, percent int, name func(filename string) string) error {
+	for _, region := range regions {
+		output := regionFilename(name(scene.OutputFilename), region, len(regions))
+		checkpointFile := scene.CheckpointFilename
+		if checkpointFile == "" {
+			checkpointFile = scene.OutputFilename + ".checkpoint"
+		}
+		checkpoints := newCheckpointer(&scene.Config, regionFilename(name(checkpointFile), region, len(regions)))
+		preview := scene.PreviewFilename
+		if preview == "" {
+			preview = scene.OutputFilename
+		}
+		preview = regionFilename(name(preview), region, len(regions))
+
+		resume := scene.Resume
+		if resume && (len(scene.Frames) > 0 || scene.AllCameras) {
+			// Resumed sequences skip finished outputs and start the ones without a checkpoint.
+			_, err := os.Stat(checkpoints.filename)
+			resume = err == nil
+			if _, err := os.Stat(output); !resume && err == nil {
+				scene.logf("%s is already rendered", output)
+				continue
+			}
+		}
+		err := renderRegion(ctx, scene, region, percent, output, preview, checkpoints, resume)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Set color for each pixel.
+// renderRegion renders a region of the frame into output.
+func renderRegion(ctx context.Context, scene *Scene, region Region, percent int, output, preview string, checkpoints *checkpointer, resume bool) error {
+	if err := scene.setRegion(ctx, region); err != nil {
+		return err
+	}
+	scene.logf("Initial rendering: %d x %d, region %s\n", scene.Width, scene.Height, region)
 
-	scene.Width = width
-	scene.Height = height
+	if resume {
+		err := checkpoints.restore(scene)
+		if err != nil {
+			return err
+		}
+	}
+	if err := renderPixels(ctx, scene, percent, preview, checkpoints); err != nil {
+		// Stopped renders keep what they have for --resume.
+		if ctx.Err() != nil && checkpoints.interval > 0 {
+			if serr := checkpoints.save(scene); serr != nil {
+				scene.logf("Error writing checkpoint %s: %s", checkpoints.filename, serr.Error())
+			}
+		}
+		return err
+	}
+	err := writeOutput(scene, output)
+	if err != nil {
+		return err
+	}
+	checkpoints.remove(scene)
+	return nil
+}
 
-	totalPixels, pixellist := getPixelList(width, height, left, right, top, bottom, percent)
-	bar := pb.StartNew(totalPixels)
+// renderPixels renders the scanned pixels of the scene: the main pass, then
+// progressive or adaptive sampling and denoising.
+func renderPixels(ctx context.Context, scene *Scene, percent int, preview string, checkpoints *checkpointer) error {
+	start := time.Now()
+	orderRandom := scene.random(streamPixelOrder)
+	totalPixels, pixellist := getPixelList(&orderRandom, scene.Width, scene.Height, percent)
+	pixels := make([]pixelCoord, totalPixels)
+	stage := scene.startStage(StageRender, totalPixels)
 
 	for i := 0; i < totalPixels; i++ {
-		y := int(math.Floor(float64(pixellist[i])/float64(width))) + top
-		x := (pixellist[i] % width) + left
-		renderPixel(scene, x, y)
-		bar.Increment()
+		if err := ctx.Err(); err != nil {
+			stage.finish()
+			return err
+		}
+		y := pixellist[i] / scene.Width
+		x := pixellist[i] % scene.Width
+		pixels[i] = pixelCoord{x: x, y: y}
+		// Resumed pixels are already rendered.
+		if scene.Pixels[x][y].Samples == 0 {
+			renderPixel(scene, x, y)
+		}
+		stage.increment()
+		checkpoints.maybeSave(scene)
+	}
+	stage.finish()
+	if checkpoints.pass < 1 {
+		checkpoints.pass = 1
 	}
-	bar.Finish()
 
-	log.Printf("Rendered scene in %f seconds\n", time.Since(start).Seconds())
-	log.Printf("Second pass for antialiasing and image generation")
-	renderImage(scene, img)
-	// Encode as PNG.
-	f, _ := os.Create(scene.OutputFilename)
-	return png.Encode(f, img)
+	scene.logf("Rendered scene in %f seconds\n", time.Since(start).Seconds())
+	// Main pass gives a first look at the image.
+	scene.reporter().TileCompleted(scene.tile(scene.Region))
+	if scene.Config.Progressive {
+		// Accumulated jittered samples antialias the image already.
+		err := renderProgressive(ctx, scene, pixels, start, checkpoints, preview)
+		if err != nil {
+			return err
+		}
+	} else {
+		scene.logf("Adaptive sampling pass for antialiasing")
+		if err := renderImage(ctx, scene, pixels, checkpoints); err != nil {
+			return err
+		}
+	}
+	if err := denoise(ctx, scene); err != nil {
+		return err
+	}
+	scene.reporter().TileCompleted(scene.tile(scene.Region))
+	return nil
 }
@@ -0,0 +1,118 @@
+package raytracer
+
+/*
+Cube map rendering. Six 90 degree faces are rendered from the camera
+position, oriented by the camera view. Faces are packed into one frame
+as a 6x1 strip or a 3x2 grid in right, left, up, down, front, back
+order, or written into one file per face.
+*/
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Cube map layouts.
+const (
+	CubeStrip    = "strip"
+	CubeGrid     = "grid"
+	CubeSeparate = "separate"
+)
+
+var cubeFaceNames = [6]string{"right", "left", "up", "down", "front", "back"}
+
+func checkCubeMap(c *Camera) error {
+	if c.Type != CameraCubeMap {
+		return nil
+	}
+	switch c.CubeLayout {
+	case "":
+		c.CubeLayout = CubeStrip
+	case CubeStrip, CubeGrid, CubeSeparate:
+	default:
+		return fmt.Errorf("camera %s has unknown cube map layout %s", c.Name, c.CubeLayout)
+	}
+	return nil
+}
+
+// cubeGrid is the number of face columns and rows in the frame.
+func (c *Camera) cubeGrid() (int, int) {
+	if c.CubeLayout == CubeGrid {
+		return 3, 2
+	}
+	return 6, 1
+}
+
+// cubeFrameSize fits square faces into the frame.
+func (c *Camera) cubeFrameSize(width, height int) (int, int) {
+	columns, rows := c.cubeGrid()
+	face := minInt(width/columns, height/rows)
+	return face * columns, face * rows
+}
+
+// cubeFace maps frame coordinates to the face they fall in and the coordinates in the face.
+func (c *Camera) cubeFace(x, y float64) (float64, float64, int) {
+	columns, rows := c.cubeGrid()
+	column := minInt(int(math.Floor(x+0.5))/c.width, columns-1)
+	row := minInt(int(math.Floor(y+0.5))/c.height, rows-1)
+	return x - float64(column*c.width), y - float64(row*c.height), row*columns + column
+}
+
+// cubeFaceRay looks through face coordinates u, v in -1..1.
+func cubeFaceRay(u, v float64, face int, view Matrix) Vector {
+	side, up, forward := viewAxes(view)
+	back := scaleVector(forward, -1)
+	var faceForward, faceSide, faceUp Vector
+	switch face {
+	case 0:
+		faceForward, faceSide, faceUp = side, back, up
+	case 1:
+		faceForward, faceSide, faceUp = scaleVector(side, -1), forward, up
+	case 2:
+		faceForward, faceSide, faceUp = up, side, back
+	case 3:
+		faceForward, faceSide, faceUp = scaleVector(up, -1), side, forward
+	case 4:
+		faceForward, faceSide, faceUp = forward, side, up
+	default:
+		faceForward, faceSide, faceUp = back, scaleVector(side, -1), up
+	}
+	return normalizeVector(addVector(faceForward, combine(faceSide, faceUp, u, v)))
+}
+
+func cubeFaceFilename(filename string, face int) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + cubeFaceNames[face] + ext
+}
+
+// separateCubeFaces tells if the rendered frame is written as one file per face.
+func (s *Scene) separateCubeFaces() bool {
+	camera := s.camera()
+	return camera.Type == CameraCubeMap && camera.CubeLayout == CubeSeparate
+}
+
+// writeCubeFaces writes every face of the frame into its own file.
+func writeCubeFaces(scene *Scene, filename string) error {
+	if !scene.fullFrame() {
+		scene = scene.framedScene()
+	}
+	columns, _ := scene.camera().cubeGrid()
+	size := scene.frameWidth / columns
+	for face := range cubeFaceNames {
+		left, top := (face%columns)*size, (face/columns)*size
+		faceScene := *scene
+		faceScene.Width, faceScene.Height = size, size
+		faceScene.frameWidth, faceScene.frameHeight = size, size
+		faceScene.Region = Region{Left: 0, Top: 0, Right: size, Bottom: size}
+		faceScene.Pixels = make([][]PixelStorage, size)
+		for i := 0; i < size; i++ {
+			faceScene.Pixels[i] = scene.Pixels[left+i][top : top+size]
+		}
+		if err := writeImage(&faceScene, cubeFaceFilename(filename, face)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,6 +15,13 @@ func PrintMemUsage() {
 	fmt.Printf("\tNumGC = %v\n", m.NumGC)
 }
 
+// logMemUsage sends the memory statistics to the scene reporter.
+func (s *Scene) logMemUsage() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s.logf("Alloc = %v MiB\tTotalAlloc = %v MiB\tSys = %v MiB\tNumGC = %v", bToMb(m.Alloc), bToMb(m.TotalAlloc), bToMb(m.Sys), m.NumGC)
+}
+
 func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
 }
@@ -0,0 +1,160 @@
+package raytracer
+
+/*
+Joint bilateral denoiser. Pixel colors are blurred with neighbours that
+share the same surface: weights come from albedo, normal and depth
+information gathered in the main pass. Lighting is filtered on its own,
+textures are put back afterwards so they stay sharp.
+*/
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Guide sensitivities. Smaller values keep more edges.
+const (
+	denoiseAlbedoSigma = 0.1
+	denoiseNormalSigma = 0.1
+	denoiseDepthSigma  = 0.05
+)
+
+// demodulate divides out the albedo so only lighting is filtered.
+func demodulate(color, albedo Vector) Vector {
+	result := color
+	for i := 0; i < 3; i++ {
+		if albedo[i] > DIFF {
+			result[i] = color[i] / albedo[i]
+		}
+	}
+	return result
+}
+
+func remodulate(light, albedo Vector) Vector {
+	result := light
+	for i := 0; i < 3; i++ {
+		if albedo[i] > DIFF {
+			result[i] = light[i] * albedo[i]
+		}
+	}
+	return result
+}
+
+func denoiseWeight(center, other *PixelStorage, centerLight, otherLight Vector, spatial, strength float64) float64 {
+	if !other.WorldLocation.Hit {
+		return 0
+	}
+	albedoDist := 0.0
+	colorDist := 0.0
+	for i := 0; i < 3; i++ {
+		a := center.Albedo[i] - other.Albedo[i]
+		c := centerLight[i] - otherLight[i]
+		albedoDist += a * a
+		colorDist += c * c
+	}
+	// Color difference is relative to the center brightness so it works for any exposure.
+	lum := luminance(centerLight)
+	colorDist /= lum*lum + 0.0001
+
+	normalDist := 1 - dot(center.Normal, other.Normal)
+	depthDist := math.Abs(center.WorldLocation.Dist-other.WorldLocation.Dist) / math.Max(center.WorldLocation.Dist, DIFF)
+
+	return spatial *
+		math.Exp(-albedoDist/(2*denoiseAlbedoSigma*denoiseAlbedoSigma)) *
+		math.Exp(-normalDist/denoiseNormalSigma) *
+		math.Exp(-depthDist/denoiseDepthSigma) *
+		math.Exp(-colorDist/(2*strength*strength))
+}
+
+// denoise the rendered pixel colors in place.
+func denoise(ctx context.Context, scene *Scene) error {
+	radius := scene.Config.DenoiseRadius
+	strength := scene.Config.DenoiseStrength
+	if !scene.Config.Denoise || radius < 1 || strength <= 0 {
+		return nil
+	}
+	scene.logf("Denoising with radius %d and strength %f", radius, strength)
+
+	lights := make([][]Vector, scene.Width)
+	for i := 0; i < scene.Width; i++ {
+		lights[i] = make([]Vector, scene.Height)
+		for j := 0; j < scene.Height; j++ {
+			lights[i][j] = demodulate(scene.Pixels[i][j].Color, scene.Pixels[i][j].Albedo)
+		}
+	}
+
+	spatialSigma := float64(radius) / 2
+	spatial := make([][]float64, 2*radius+1)
+	for dx := -radius; dx <= radius; dx++ {
+		spatial[dx+radius] = make([]float64, 2*radius+1)
+		for dy := -radius; dy <= radius; dy++ {
+			spatial[dx+radius][dy+radius] = math.Exp(-float64(dx*dx+dy*dy) / (2 * spatialSigma * spatialSigma))
+		}
+	}
+
+	result := make([][]Vector, scene.Width)
+	stage := scene.startStage(StageDenoise, scene.Width)
+	columns := make(chan int, scene.Width)
+	for i := 0; i < scene.Width; i++ {
+		columns <- i
+	}
+	close(columns)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range columns {
+				if ctx.Err() != nil {
+					continue
+				}
+				result[i] = make([]Vector, scene.Height)
+				for j := 0; j < scene.Height; j++ {
+					center := &scene.Pixels[i][j]
+					if !center.WorldLocation.Hit {
+						result[i][j] = center.Color
+						continue
+					}
+					total := Vector{}
+					totalWeight := 0.0
+					for dx := -radius; dx <= radius; dx++ {
+						for dy := -radius; dy <= radius; dy++ {
+							x, y := i+dx, j+dy
+							if x < 0 || y < 0 || x >= scene.Width || y >= scene.Height {
+								continue
+							}
+							w := denoiseWeight(center, &scene.Pixels[x][y], lights[i][j], lights[x][y], spatial[dx+radius][dy+radius], strength)
+							if w < DIFF {
+								continue
+							}
+							for c := 0; c < 3; c++ {
+								total[c] += lights[x][y][c] * w
+							}
+							totalWeight += w
+						}
+					}
+					filtered := scaleVector(total, 1/totalWeight)
+					filtered[3] = center.Color[3]
+					result[i][j] = remodulate(filtered, center.Albedo)
+				}
+				stage.increment()
+			}
+		}()
+	}
+	wg.Wait()
+	stage.finish()
+	// Stopped denoising leaves the pixels untouched.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for i := 0; i < scene.Width; i++ {
+		for j := 0; j < scene.Height; j++ {
+			scene.Pixels[i][j].Color = result[i][j]
+		}
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ Light related methods
 
 import (
 	"math"
+	"sync"
 )
 
 const sunDist = 99999999999.00
@@ -15,10 +16,10 @@ func isShortestIntersection(inter *Intersection, sInter *Intersection) bool {
 	return (sInter.Triangle != nil && sInter.Triangle.id == inter.Triangle.id) || sInter.Dist < DIFF
 }
 
-func isFlatGlass(inter *Intersection, sInter *Intersection) bool {
+func isFlatGlass(scene *Scene, inter *Intersection, sInter *Intersection) bool {
 	return (sInter.Hit && sInter.Triangle != nil) &&
 		(sInter.Triangle.id != inter.Triangle.id) && (sInter.Triangle.Material.Transmission > 0) &&
-		(GlobalConfig.RenderRefractions)
+		(scene.Config.RenderRefractions)
 	//  && (!sInter.Triangle.Smooth)
 }
 
@@ -35,10 +36,6 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 		return
 	}
 
-	if light.Samples == nil {
-		light.Samples = sampleSphere(sunRadius, GlobalConfig.LightSampleCount)
-	}
-
 	totalHits := 0.0
 	totalLight := Vector{}
 
@@ -46,14 +43,14 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 		rayStart := addVectors(scaleVector(lightD, sunDist), intersection.Intersection, light.Samples[i])
 		dir := normalizeVector(subVector(rayStart, intersection.Intersection))
 
-		shortestIntersection = raycastSceneIntersect(scene, intersection.Intersection, dir)
+		shortestIntersection = raycastSceneIntersect(scene, intersection.Intersection, dir, intersection.Time)
 		if isShortestIntersection(intersection, &shortestIntersection) {
 			if !sameSideTest(intersection.IntersectionNormal, shortestIntersection.IntersectionNormal, 0) {
 				return
 			}
 
 			intensity := dotP * light.LightStrength
-			intensity *= GlobalConfig.Exposure
+			intensity *= scene.Config.Exposure
 
 			totalLight = addVector(totalLight, Vector{
 				light.Color[0] * intensity,
@@ -65,8 +62,8 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 		}
 
 		// Let things pass if this is a regular glass
-		if isFlatGlass(intersection, &shortestIntersection) {
-			col := shortestIntersection.getColor()
+		if isFlatGlass(scene, intersection, &shortestIntersection) {
+			col := shortestIntersection.getColor(scene)
 			lColor := Vector{
 				light.Color[0] * col[0],
 				light.Color[1] * col[1],
@@ -74,7 +71,7 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 				1,
 			}
 
-			intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * GlobalConfig.Exposure
+			intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * scene.Config.Exposure
 			intensity *= dotP * light.LightStrength * shortestIntersection.Triangle.Material.Transmission
 			if intensity > DIFF && intensity < light.LightStrength {
 				subLight := Light{
@@ -88,7 +85,7 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 		}
 	}
 	if totalHits > 0 {
-		return scaleVector(totalLight, totalHits/float64(GlobalConfig.LightSampleCount))
+		return scaleVector(totalLight, totalHits/float64(scene.Config.LightSampleCount))
 	}
 
 	return
@@ -114,9 +111,9 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 			intersection.Triangle.Material.LightStrength = light.LightStrength
 		}
 		return Vector{
-			GlobalConfig.Exposure * light.Color[0] * intersection.Triangle.Material.LightStrength,
-			GlobalConfig.Exposure * light.Color[1] * intersection.Triangle.Material.LightStrength,
-			GlobalConfig.Exposure * light.Color[2] * intersection.Triangle.Material.LightStrength,
+			scene.Config.Exposure * light.Color[0] * intersection.Triangle.Material.LightStrength,
+			scene.Config.Exposure * light.Color[1] * intersection.Triangle.Material.LightStrength,
+			scene.Config.Exposure * light.Color[2] * intersection.Triangle.Material.LightStrength,
 			1,
 		}
 	}
@@ -124,7 +121,7 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 	rayDir := normalizeVector(subVector(intersection.Intersection, light.Position))
 	rayLength := vectorDistance(intersection.Intersection, light.Position)
 
-	shortestIntersection := raycastSceneIntersect(scene, light.Position, rayDir)
+	shortestIntersection := raycastSceneIntersect(scene, light.Position, rayDir, intersection.Time)
 	s := math.Abs(rayLength - shortestIntersection.Dist)
 
 	if (shortestIntersection.Triangle != nil && shortestIntersection.Triangle.id == intersection.Triangle.id) || s < DIFF {
@@ -132,11 +129,11 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 			return
 		}
 
-		intensity := (1 / (rayLength * rayLength)) * GlobalConfig.Exposure
+		intensity := (1 / (rayLength * rayLength)) * scene.Config.Exposure
 		intensity *= dotP * light.LightStrength
 
 		if intersection.Triangle.Material.LightStrength > 0 {
-			intensity = intersection.Triangle.Material.LightStrength * GlobalConfig.Exposure
+			intensity = intersection.Triangle.Material.LightStrength * scene.Config.Exposure
 		}
 
 		return Vector{
@@ -148,8 +145,8 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 	}
 
 	// Let things pass if this is a regular glass
-	if isFlatGlass(intersection, &shortestIntersection) {
-		col := shortestIntersection.getColor()
+	if isFlatGlass(scene, intersection, &shortestIntersection) {
+		col := shortestIntersection.getColor(scene)
 		lColor := Vector{
 			light.Color[0] * col[0],
 			light.Color[1] * col[1],
@@ -157,7 +154,7 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 			1,
 		}
 
-		intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * GlobalConfig.Exposure
+		intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * scene.Config.Exposure
 		intensity *= dotP * light.LightStrength * shortestIntersection.Triangle.Material.Transmission
 		if intensity > DIFF && intensity < light.LightStrength {
 			subLight := Light{
@@ -173,7 +170,7 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 }
 
 func calculateTotalLight(scene *Scene, intersection *Intersection, depth int) (result Vector) {
-	if (!intersection.Hit) || (depth >= GlobalConfig.MaxReflectionDepth) {
+	if (!intersection.Hit) || (depth >= scene.Config.MaxReflectionDepth) {
 		return
 	}
 
@@ -182,31 +179,34 @@ func calculateTotalLight(scene *Scene, intersection *Intersection, depth int) (r
 		return c
 	}
 
-	lightChan := make(chan Vector, len(scene.Lights))
-
+	// Lights are summed in order, so the result doesn't depend on scheduling.
+	lights := make([]Vector, len(scene.Lights))
+	var wg sync.WaitGroup
 	for i := range scene.Lights {
-		go func(scene *Scene, intersection *Intersection, light *Light, depth int, lightChan chan Vector) {
+		wg.Add(1)
+		go func(scene *Scene, intersection *Intersection, light *Light, depth int, result *Vector) {
+			defer wg.Done()
 			if light.Directional {
-				lightChan <- calculateDirectionalLight(scene, intersection, light, depth)
+				*result = calculateDirectionalLight(scene, intersection, light, depth)
 			} else {
-				lightChan <- calculateLight(scene, intersection, light, depth)
+				*result = calculateLight(scene, intersection, light, depth)
 			}
-		}(scene, intersection, &scene.Lights[i], depth, lightChan)
+		}(scene, intersection, &scene.Lights[i], depth, &lights[i])
 	}
+	wg.Wait()
 
 	result = Vector{}
-	for i := 0; i < len(scene.Lights); i++ {
-		light := <-lightChan
+	for _, light := range lights {
 		if light[3] > 0 {
 			result = addVector(result, light)
 		}
 	}
 
-	if GlobalConfig.PhotonSpacing > 0 && GlobalConfig.RenderCaustics {
+	if scene.Config.PhotonSpacing > 0 && scene.Config.RenderCaustics {
 		if intersection.Triangle.Photons != nil && len(intersection.Triangle.Photons) > 0 {
 			for i := range intersection.Triangle.Photons {
-				if vectorDistance(intersection.Triangle.Photons[i].Location, intersection.Intersection) < GlobalConfig.PhotonSpacing {
-					c := scaleVector(intersection.Triangle.Photons[i].Color, GlobalConfig.Exposure)
+				if vectorDistance(intersection.Triangle.Photons[i].Location, intersection.Intersection) < scene.Config.PhotonSpacing {
+					c := scaleVector(intersection.Triangle.Photons[i].Color, scene.Config.Exposure)
 					result = addVector(result, c)
 				}
 			}
@@ -0,0 +1,198 @@
+package raytracer
+
+/*
+Display transform: turns linear scene radiance into display referred
+colors for low dynamic range outputs.
+exposure -> white balance -> tone mapping -> sRGB transfer function
+Exposure is metered for the scene before writing, see exposure.go.
+*/
+
+import (
+	"fmt"
+	"math"
+)
+
+// Tone mapping operators.
+const (
+	ToneMapClamp    = "clamp"
+	ToneMapReinhard = "reinhard"
+	ToneMapACES     = "aces"
+	ToneMapAgX      = "agx"
+)
+
+// neutralWhiteBalance is the temperature that leaves colors untouched.
+const neutralWhiteBalance = 6500.0
+
+var srgbToLinearTable [256]float64
+
+func init() {
+	for i := range srgbToLinearTable {
+		srgbToLinearTable[i] = srgbToLinear(float64(i) / 255)
+	}
+}
+
+type displayTransform struct {
+	exposure float64
+	balance  Vector
+	operator string
+	srgb     bool
+}
+
+func newDisplayTransform(scene *Scene) (*displayTransform, error) {
+	operator := scene.Config.ToneMapping
+	if operator == "" {
+		operator = ToneMapClamp
+	}
+	switch operator {
+	case ToneMapClamp, ToneMapReinhard, ToneMapACES, ToneMapAgX:
+	default:
+		return nil, fmt.Errorf("unknown tone mapping operator %s", operator)
+	}
+	return &displayTransform{
+		exposure: scene.exposure,
+		balance:  whiteBalance(scene.Config.WhiteBalance),
+		operator: operator,
+		srgb:     scene.Config.SRGBOutput,
+	}, nil
+}
+
+// apply the display transform, result is in 0..1 range.
+func (d *displayTransform) apply(c Vector) Vector {
+	result := Vector{
+		c[0] * d.exposure * d.balance[0],
+		c[1] * d.exposure * d.balance[1],
+		c[2] * d.exposure * d.balance[2],
+		c[3],
+	}
+	switch d.operator {
+	case ToneMapReinhard:
+		result = reinhard(result)
+	case ToneMapACES:
+		result = acesFilmic(result)
+	case ToneMapAgX:
+		result = agx(result)
+	}
+	result = limitVector(result, 1.0)
+	for i := 0; i < 3; i++ {
+		result[i] = math.Max(result[i], 0)
+		if d.srgb {
+			result[i] = linearToSRGB(result[i])
+		}
+	}
+	return result
+}
+
+func reinhard(c Vector) Vector {
+	return Vector{
+		c[0] / (1 + c[0]),
+		c[1] / (1 + c[1]),
+		c[2] / (1 + c[2]),
+		c[3],
+	}
+}
+
+// acesFilmic is Krzysztof Narkowicz's fit of the ACES reference rendering transform.
+func acesFilmic(c Vector) Vector {
+	curve := func(x float64) float64 {
+		return (x * (2.51*x + 0.03)) / (x*(2.43*x+0.59) + 0.14)
+	}
+	return Vector{curve(c[0]), curve(c[1]), curve(c[2]), c[3]}
+}
+
+// agx is a minimal AgX approximation: log encoding in a slightly desaturated
+// space followed by a sigmoid curve, giving smooth highlight roll off.
+func agx(c Vector) Vector {
+	const minEv = -12.47393
+	const maxEv = 4.026069
+	inset := Matrix{
+		Vector{0.842479062253094, 0.0784335999999992, 0.0792237451477643, 0},
+		Vector{0.0423282422610123, 0.878468636469772, 0.0791661274605434, 0},
+		Vector{0.0423756549057051, 0.0784336, 0.879142973793104, 0},
+	}
+	outset := Matrix{
+		Vector{1.19687900512017, -0.0980208811401368, -0.0990297440797205, 0},
+		Vector{-0.0528968517574562, 1.15190312990417, -0.0989611768448433, 0},
+		Vector{-0.0529716355144438, -0.0980434501171241, 1.15107367264116, 0},
+	}
+	sigmoid := func(x float64) float64 {
+		x2 := x * x
+		x4 := x2 * x2
+		return 15.5*x4*x2 - 40.14*x4*x + 31.96*x4 - 6.868*x2*x + 0.4298*x2 + 0.1191*x - 0.00232
+	}
+	v := Vector{}
+	for i := 0; i < 3; i++ {
+		x := inset[i][0]*c[0] + inset[i][1]*c[1] + inset[i][2]*c[2]
+		x = math.Log2(math.Max(x, 1e-10))
+		x = (math.Min(math.Max(x, minEv), maxEv) - minEv) / (maxEv - minEv)
+		v[i] = sigmoid(x)
+	}
+	result := Vector{0, 0, 0, c[3]}
+	for i := 0; i < 3; i++ {
+		x := outset[i][0]*v[0] + outset[i][1]*v[1] + outset[i][2]*v[2]
+		// Back to linear so the sRGB transfer can be applied like the others.
+		result[i] = math.Pow(math.Max(x, 0), 2.2)
+	}
+	return result
+}
+
+// whiteBalance returns channel gains to neutralize given color temperature in Kelvin.
+func whiteBalance(kelvin float64) Vector {
+	if kelvin <= 0 {
+		return Vector{1, 1, 1, 1}
+	}
+	white := blackbodyColor(kelvin)
+	reference := blackbodyColor(neutralWhiteBalance)
+	gains := Vector{
+		reference[0] / white[0],
+		reference[1] / white[1],
+		reference[2] / white[2],
+		1,
+	}
+	// Keep the overall brightness
+	lum := luminance(gains)
+	return Vector{gains[0] / lum, gains[1] / lum, gains[2] / lum, 1}
+}
+
+// blackbodyColor approximates linear RGB color of a black body, Tanner Helland's fit.
+func blackbodyColor(kelvin float64) Vector {
+	t := math.Min(math.Max(kelvin, 1000), 40000) / 100
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	switch {
+	case t >= 66:
+		b = 255
+	case t <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	clamp := func(x float64) float64 {
+		return srgbToLinear(math.Min(math.Max(x, 1), 255) / 255)
+	}
+	return Vector{clamp(r), clamp(g), clamp(b), 1}
+}
+
+func luminance(c Vector) float64 {
+	return 0.2126*c[0] + 0.7152*c[1] + 0.0722*c[2]
+}
+
+// linearToSRGB is the sRGB opto-electronic transfer function.
+func linearToSRGB(x float64) float64 {
+	if x <= 0.0031308 {
+		return x * 12.92
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+func srgbToLinear(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
@@ -0,0 +1,595 @@
+package raytracer
+
+/*
+Distributed rendering. A coordinator loads the scene, splits the image
+into tiles and hands them out to workers over HTTP. Workers download the
+scene with its textures, render the tiles they lease and post the pixels
+back. Workers send heartbeats while rendering; tiles of workers that
+disappear go back to the queue, so workers can join and leave anytime.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	leaseTimeout       = 30 * time.Second
+	heartbeatInterval  = 10 * time.Second
+	workerPollInterval = 2 * time.Second
+	workerRetries      = 5
+	downloadTimeout    = 30 * time.Minute
+)
+
+var (
+	// controlClient leases tiles, heartbeats and posts results, requests
+	// to a stalled coordinator fail before the lease would expire.
+	controlClient = &http.Client{Timeout: leaseTimeout}
+	// downloadClient fetches the scene and its assets, which can be large.
+	downloadClient = &http.Client{Timeout: downloadTimeout}
+)
+
+type renderTile struct {
+	ID     int `json:"id"`
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+}
+
+// renderJob is everything a worker needs to render the same image as the coordinator.
+type renderJob struct {
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	Config         Config   `json:"config"`
+	Scene          string   `json:"scene"`
+	Camera         string   `json:"camera"`
+	Assets         []string `json:"assets"`
+	EnvironmentMap string   `json:"environment_map"`
+}
+
+type coordinator struct {
+	sync.Mutex
+	scene     *Scene
+	job       renderJob
+	assets    map[string]string
+	tiles     []renderTile
+	pending   []int
+	leases    map[int]time.Time
+	done      map[int]bool
+	finished  chan bool
+	tileStage *progress
+}
+
+func splitTiles(width, height, size int) []renderTile {
+	tiles := make([]renderTile, 0)
+	for top := 0; top < height; top += size {
+		for left := 0; left < width; left += size {
+			tiles = append(tiles, renderTile{
+				ID:     len(tiles),
+				Left:   left,
+				Top:    top,
+				Right:  minInt(left+size, width),
+				Bottom: minInt(top+size, height),
+			})
+		}
+	}
+	return tiles
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sceneTextures lists texture names used by the objects and their children.
+func sceneTextures(objects map[string]*Object) []string {
+	found := make(map[string]bool)
+	var walk func(objects map[string]*Object)
+	walk = func(objects map[string]*Object) {
+		for _, obj := range objects {
+			for _, mat := range obj.Materials {
+				if mat.Texture != "" {
+					found[mat.Texture] = true
+				}
+			}
+			walk(obj.Children)
+		}
+	}
+	walk(objects)
+	result := make([]string, 0, len(found))
+	for texture := range found {
+		result = append(result, texture)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// addAsset shares a scene file with workers, name is the path relative to the scene.
+func (c *coordinator) addAsset(scenePath, name string) {
+	filename := name
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		filename = filepath.Join(scenePath, name)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return
+	}
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		c.scene.logf("%s is outside of the scene directory, workers need it at the same path", name)
+		return
+	}
+	c.assets[name] = filename
+	c.job.Assets = append(c.job.Assets, name)
+}
+
+// Serve the scene to workers and assemble the image they render, until ctx is done.
+func Serve(ctx context.Context, scene *Scene, size string, port, tileSize int) error {
+	width, height, err := getWidthHeight(scene, size)
+	if err != nil {
+		return err
+	}
+	cameras, err := scene.selectCameras()
+	if err != nil {
+		return err
+	}
+	if len(cameras) > 1 {
+		return fmt.Errorf("distributed rendering renders one camera at a time")
+	}
+	scene.cameraIndex = cameras[0]
+	width, height = scene.cameraFrameSize(cameras[0], width, height)
+	if tileSize < 1 {
+		return fmt.Errorf("invalid tile size %d", tileSize)
+	}
+	// Coordinator doesn't raycast, pixels come from the workers.
+	scene.frameWidth = width
+	scene.frameHeight = height
+	scene.Region = Region{Left: 0, Top: 0, Right: width, Bottom: height}
+	scene.Width = width
+	scene.Height = height
+	scene.allocatePixels()
+
+	c := &coordinator{
+		scene: scene,
+		job: renderJob{
+			Width:  width,
+			Height: height,
+			Config: scene.Config,
+			Scene:  filepath.Base(scene.InputFilename),
+			Camera: scene.camera().Name,
+			Assets: make([]string, 0),
+		},
+		assets:   make(map[string]string),
+		tiles:    splitTiles(width, height, tileSize),
+		leases:   make(map[int]time.Time),
+		done:     make(map[int]bool),
+		finished: make(chan bool),
+	}
+	scenePath := filepath.Dir(scene.InputFilename)
+	for _, texture := range sceneTextures(scene.Objects) {
+		c.addAsset(scenePath, texture)
+		c.addAsset(scenePath, bumpMapFilename(texture))
+	}
+	if scene.environmentMap != "" {
+		c.job.EnvironmentMap = "environment" + filepath.Ext(scene.environmentMap)
+		c.assets[c.job.EnvironmentMap] = scene.environmentMap
+	}
+	c.pending = make([]int, len(c.tiles))
+	for i := range c.tiles {
+		c.pending[i] = i
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/job", c.handleJob)
+	mux.HandleFunc("/scene", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, scene.InputFilename)
+	})
+	mux.HandleFunc("/asset", c.handleAsset)
+	mux.HandleFunc("/tile/lease", c.handleLease)
+	mux.HandleFunc("/tile/heartbeat", c.handleHeartbeat)
+	mux.HandleFunc("/tile/result", c.handleResult)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	start := time.Now()
+	scene.logf("Coordinator listening on port %d, %d tiles of %d x %d to render", port, len(c.tiles), width, height)
+	c.tileStage = scene.startStage(StageTiles, len(c.tiles))
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			c.tileStage.finish()
+			_ = server.Shutdown(context.Background())
+			return ctx.Err()
+		case <-c.finished:
+			break wait
+		case <-ticker.C:
+			c.expireLeases()
+		}
+	}
+	c.tileStage.finish()
+	scene.logf("Distributed render finished in %f seconds", time.Since(start).Seconds())
+
+	err = denoise(ctx, scene)
+	if err == nil {
+		err = writeOutput(scene, scene.OutputFilename)
+	}
+	// Keep answering a little longer so waiting workers learn the job is done.
+	time.Sleep(2 * workerPollInterval)
+	_ = server.Shutdown(context.Background())
+	return err
+}
+
+func (c *coordinator) handleJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.job)
+}
+
+func (c *coordinator) handleAsset(w http.ResponseWriter, r *http.Request) {
+	filename, ok := c.assets[r.URL.Query().Get("name")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filename)
+}
+
+func tileID(r *http.Request) (int, error) {
+	return strconv.Atoi(r.URL.Query().Get("id"))
+}
+
+func (c *coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.done) == len(c.tiles) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if len(c.pending) == 0 {
+		// Everything is leased, worker should ask again later.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id := c.pending[0]
+	c.pending = c.pending[1:]
+	c.leases[id] = time.Now()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.tiles[id])
+}
+
+func (c *coordinator) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id, err := tileID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.leases[id]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c.leases[id] = time.Now()
+}
+
+func (c *coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := tileID(r)
+	if err != nil || id < 0 || id >= len(c.tiles) {
+		http.Error(w, "invalid tile id", http.StatusBadRequest)
+		return
+	}
+	var pixels []storedPixel
+	if err := gob.NewDecoder(r.Body).Decode(&pixels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := c.tiles[id]
+	if len(pixels) != (t.Right-t.Left)*(t.Bottom-t.Top) {
+		http.Error(w, "pixel count doesn't match the tile", http.StatusBadRequest)
+		return
+	}
+	for i := range pixels {
+		if pixels[i].X < t.Left || pixels[i].X >= t.Right || pixels[i].Y < t.Top || pixels[i].Y >= t.Bottom {
+			http.Error(w, "pixel outside of the tile", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.done[id] {
+		// Expired lease finished after all, the tile is already rendered.
+		return
+	}
+	for i := range pixels {
+		p := &c.scene.Pixels[pixels[i].X][pixels[i].Y]
+		p.restore(&pixels[i])
+		// Coordinator doesn't raycast, denoiser needs these.
+		p.WorldLocation.Hit = pixels[i].Hit
+		p.WorldLocation.Dist = pixels[i].Depth
+	}
+	c.done[id] = true
+	delete(c.leases, id)
+	c.removePending(id)
+	c.scene.reporter().TileCompleted(c.scene.tile(Region{Left: t.Left, Top: t.Top, Right: t.Right, Bottom: t.Bottom}))
+	c.tileStage.increment()
+	if len(c.done) == len(c.tiles) {
+		close(c.finished)
+	}
+}
+
+func (c *coordinator) removePending(id int) {
+	for i := range c.pending {
+		if c.pending[i] == id {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// expireLeases puts the tiles of silent workers back to the queue.
+func (c *coordinator) expireLeases() {
+	c.Lock()
+	defer c.Unlock()
+	for id, heartbeat := range c.leases {
+		if time.Since(heartbeat) < leaseTimeout {
+			continue
+		}
+		c.scene.logf("Lease of tile %d expired, requeueing", id)
+		delete(c.leases, id)
+		c.pending = append(c.pending, id)
+	}
+}
+
+// worker talks to a coordinator.
+type worker struct {
+	coordinator string
+	scene       Scene
+}
+
+func (wk *worker) get(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wk.coordinator+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// post sends a control request to the coordinator.
+func (wk *worker) post(ctx context.Context, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wk.coordinator+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return controlClient.Do(req)
+}
+
+func (wk *worker) download(ctx context.Context, path, filename string) error {
+	resp, err := wk.get(ctx, downloadClient, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Work renders tiles for the coordinator until the image is complete or ctx is done.
+func Work(ctx context.Context, coordinatorURL string) error {
+	wk := &worker{coordinator: strings.TrimRight(coordinatorURL, "/")}
+	resp, err := wk.get(ctx, controlClient, "/job")
+	if err != nil {
+		return err
+	}
+	var job renderJob
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("can't read job: %s", err.Error())
+	}
+
+	dir, err := ioutil.TempDir("", "raylar-worker")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// Names come from the coordinator, files must stay in the worker directory.
+	sceneFile, err := uploadPath(dir, filepath.Base(job.Scene))
+	if err != nil {
+		return err
+	}
+	wk.scene.logf("Downloading scene %s", job.Scene)
+	if err := wk.download(ctx, "/scene", sceneFile); err != nil {
+		return err
+	}
+	for _, asset := range job.Assets {
+		filename, err := uploadPath(dir, asset)
+		if err != nil {
+			return err
+		}
+		if err := wk.download(ctx, "/asset?name="+url.QueryEscape(asset), filename); err != nil {
+			return err
+		}
+	}
+	environmentMap := ""
+	if job.EnvironmentMap != "" {
+		environmentMap, err = uploadPath(dir, job.EnvironmentMap)
+		if err != nil {
+			return err
+		}
+		if err := wk.download(ctx, "/asset?name="+url.QueryEscape(job.EnvironmentMap), environmentMap); err != nil {
+			return err
+		}
+	}
+
+	if err := wk.scene.Init(ctx, sceneFile, "", environmentMap); err != nil {
+		return err
+	}
+	wk.scene.Config = job.Config
+	// Tiles are rendered adaptively, progressive pixels would have no sample cap.
+	wk.scene.Config.Progressive = false
+	wk.scene.CameraName = job.Camera
+	cameras, err := wk.scene.selectCameras()
+	if err != nil {
+		return err
+	}
+	if err := wk.scene.prepare(ctx); err != nil {
+		return err
+	}
+	wk.scene.useCamera(cameras[0], job.Width, job.Height)
+
+	failures := 0
+	for {
+		// Leased tiles of a stopped worker are given to others once their lease expires.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t, status, err := wk.lease(ctx)
+		if err != nil {
+			failures++
+			if failures >= workerRetries {
+				return err
+			}
+			wk.scene.logf("Can't lease a tile: %s", err.Error())
+			time.Sleep(workerPollInterval)
+			continue
+		}
+		failures = 0
+		switch status {
+		case http.StatusGone:
+			wk.scene.logf("Render is complete")
+			return nil
+		case http.StatusNoContent:
+			time.Sleep(workerPollInterval)
+			continue
+		}
+		if err := wk.renderTile(ctx, t); err != nil {
+			wk.scene.logf("Tile %d failed: %s", t.ID, err.Error())
+		}
+	}
+}
+
+func (wk *worker) lease(ctx context.Context) (renderTile, int, error) {
+	var t renderTile
+	resp, err := wk.post(ctx, "/tile/lease", "application/json", nil)
+	if err != nil {
+		return t, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&t)
+	case http.StatusGone, http.StatusNoContent:
+	default:
+		err = fmt.Errorf("lease: %s", resp.Status)
+	}
+	return t, resp.StatusCode, err
+}
+
+// renderTile renders the tile and posts its pixels, heartbeating meanwhile.
+func (wk *worker) renderTile(ctx context.Context, t renderTile) error {
+	wk.scene.logf("Rendering tile %d (%d, %d) - (%d, %d)", t.ID, t.Left, t.Top, t.Right, t.Bottom)
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				resp, err := wk.post(ctx, fmt.Sprintf("/tile/heartbeat?id=%d", t.ID), "application/json", nil)
+				if err != nil {
+					wk.scene.logf("Heartbeat failed: %s", err.Error())
+					continue
+				}
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	// Only the tile is scanned, pixels are indexed from its corner.
+	scene := &wk.scene
+	if err := scene.setRegion(ctx, Region{Left: t.Left, Top: t.Top, Right: t.Right, Bottom: t.Bottom}); err != nil {
+		close(stop)
+		return err
+	}
+	pixels := make([]storedPixel, 0, scene.Width*scene.Height)
+	for y := 0; y < scene.Height; y++ {
+		if err := ctx.Err(); err != nil {
+			close(stop)
+			return err
+		}
+		for x := 0; x < scene.Width; x++ {
+			renderPixel(scene, x, y)
+			refinePixel(scene, x, y)
+			pixels = append(pixels, scene.Pixels[x][y].store(x+t.Left, y+t.Top))
+		}
+	}
+	close(stop)
+
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(pixels); err != nil {
+		return err
+	}
+	resp, err := wk.post(ctx, fmt.Sprintf("/tile/result?id=%d", t.ID), "application/octet-stream", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("result: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package raytracer
+
+/*
+Errors of the render pipeline. Stopped renders return the context error,
+so errors.Is(err, context.Canceled) or context.DeadlineExceeded tells
+them apart from broken scenes.
+*/
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoCamera is returned for scenes without any cameras.
+var ErrNoCamera = errors.New("scene has no cameras")
+
+// CameraNotFoundError is returned when the asked camera is not in the scene.
+type CameraNotFoundError struct {
+	Name string
+}
+
+func (e *CameraNotFoundError) Error() string {
+	return fmt.Sprintf("scene has no camera named %s", e.Name)
+}
+
+// TextureError is a texture or environment map that can't be loaded.
+type TextureError struct {
+	Texture string
+	Err     error
+}
+
+func (e *TextureError) Error() string {
+	return fmt.Sprintf("can't load texture %s: %s", e.Texture, e.Err.Error())
+}
+
+// Unwrap returns the underlying file or decoding error.
+func (e *TextureError) Unwrap() error {
+	return e.Err
+}
+
+// MeshIndexError is a face pointing past the vertices, normals or
+// texture coordinates of its object.
+type MeshIndexError struct {
+	Object   string
+	Material string
+	Kind     string
+	Index    int64
+	Count    int
+}
+
+func (e *MeshIndexError) Error() string {
+	if e.Object == "" {
+		return fmt.Sprintf("material %s: %s index %d is out of %d", e.Material, e.Kind, e.Index, e.Count)
+	}
+	return fmt.Sprintf("object %s material %s: %s index %d is out of %d", e.Object, e.Material, e.Kind, e.Index, e.Count)
+}
@@ -0,0 +1,115 @@
+package raytracer
+
+/*
+Exposure. A camera with ISO, shutter speed and f-stop exposes like a real
+one: the exposure value at ISO 100 (EV100) maps the scene luminance that
+saturates the sensor, so lights in physical units (nits) give the
+brightness a photographer would expect. Auto exposure meters the rendered
+radiance instead and brings its log average to middle gray.
+Other cameras use the display exposure. Exposure stops are added on top
+as compensation in every mode. The exposure option is not part of this,
+it scales light intensities while lighting.
+*/
+
+import (
+	"fmt"
+	"math"
+)
+
+// Auto exposure metering modes.
+const (
+	AutoExposureAverage        = "average"
+	AutoExposureCenterWeighted = "center_weighted"
+	autoExposureOff            = ""
+)
+
+// middleGray is the display value metered luminance is mapped to.
+const middleGray = 0.18
+
+// ev100 is the exposure value at ISO 100 of the camera settings.
+func (c *Camera) ev100() (float64, bool) {
+	if c.ISO <= 0 || c.ShutterSpeed <= 0 || c.FStop <= 0 {
+		return 0, false
+	}
+	return math.Log2(c.FStop * c.FStop / c.ShutterSpeed * 100 / c.ISO), true
+}
+
+// physicalExposure scales luminance so the sensor saturates at the maximum
+// luminance of the exposure value, with the usual 78% reflected light calibration.
+func (c *Camera) physicalExposure() (float64, bool) {
+	ev, ok := c.ev100()
+	if !ok {
+		return 0, false
+	}
+	return 1 / (1.2 * math.Pow(2, ev)), true
+}
+
+// meterExposure sets the exposure the display transform uses for the scene pixels.
+func (s *Scene) meterExposure() error {
+	compensation := math.Pow(2, s.Config.ExposureStops)
+	switch s.Config.AutoExposure {
+	case autoExposureOff:
+	case AutoExposureAverage, AutoExposureCenterWeighted:
+		key, ok := s.meterLuminance(s.Config.AutoExposure == AutoExposureCenterWeighted)
+		if ok {
+			s.exposure = middleGray / key * compensation
+			s.logf("Auto exposure metered %f average luminance, exposure %f", key, s.exposure)
+			return nil
+		}
+		s.logf("Nothing to meter, auto exposure skipped")
+	default:
+		return fmt.Errorf("unknown auto exposure mode %s", s.Config.AutoExposure)
+	}
+	if exposure, ok := s.camera().physicalExposure(); ok {
+		s.exposure = exposure * compensation
+		return nil
+	}
+	s.exposure = s.Config.DisplayExposure * compensation
+	return nil
+}
+
+// checkRegionExposure refuses auto exposure for display images of a part of
+// the frame. Every region would meter its own pixels and merged regions
+// would show seams, linear outputs aren't exposed and merge fine.
+func (s *Scene) checkRegionExposure(region Region, width, height int) error {
+	if s.Config.AutoExposure == autoExposureOff || region == (Region{Left: 0, Top: 0, Right: width, Bottom: height}) {
+		return nil
+	}
+	format, err := outputFormat(s.OutputFilename, s.OutputFormat)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case FormatEXR, FormatHDR, FormatPFM:
+		return nil
+	}
+	return fmt.Errorf("auto exposure can't meter region %s alone, render the full frame or a linear format", region)
+}
+
+// meterLuminance is the log average luminance of the rendered pixels,
+// optionally weighted towards the center of the frame.
+func (s *Scene) meterLuminance(centerWeighted bool) (float64, bool) {
+	const delta = 0.0001
+	sum, weights := 0.0, 0.0
+	for i := 0; i < s.Width; i++ {
+		for j := 0; j < s.Height; j++ {
+			p := &s.Pixels[i][j]
+			if p.Samples == 0 {
+				continue
+			}
+			weight := 1.0
+			if centerWeighted {
+				// Distance from the frame center, 1 at the corners.
+				dx := (float64(i+s.Region.Left)+0.5)/float64(s.frameWidth)*2 - 1
+				dy := (float64(j+s.Region.Top)+0.5)/float64(s.frameHeight)*2 - 1
+				weight = math.Exp(-(dx*dx + dy*dy) / 0.5)
+			}
+			sum += weight * math.Log(delta+math.Max(luminance(p.Color), 0))
+			weights += weight
+		}
+	}
+	if weights == 0 {
+		return 0, false
+	}
+	return math.Exp(sum / weights), true
+}
@@ -0,0 +1,607 @@
+package raytracer
+
+/*
+OpenEXR reader and writer. Writes single part scanline images with
+multiple layers so render passes can travel in the same file as the
+color. Reader only handles what the writer produces, used to merge
+region renders.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+)
+
+const exrMagic = 20000630
+
+// EXR pixel types.
+const (
+	exrHalf  = 1
+	exrFloat = 2
+)
+
+// EXR compression methods.
+const (
+	exrNoCompression   = 0
+	exrZIPSCompression = 2
+	exrZIPCompression  = 3
+)
+
+// exrChannel is a single image channel and where its values come from.
+// x and y are relative to the data window.
+type exrChannel struct {
+	name      string
+	pixelType int32
+	value     func(x, y int) float64
+}
+
+// exrImage is a set of channels covering dataWindow of the display window.
+type exrImage struct {
+	displayWidth  int
+	displayHeight int
+	dataWindow    Region
+	channels      []exrChannel
+}
+
+func exrCompression(name string) (byte, error) {
+	switch name {
+	case "", "zip":
+		return exrZIPCompression, nil
+	case "zips":
+		return exrZIPSCompression, nil
+	case "none":
+		return exrNoCompression, nil
+	}
+	return 0, fmt.Errorf("unsupported exr compression %s, use zip, zips or none", name)
+}
+
+func exrLinesPerBlock(compression byte) (int, error) {
+	switch compression {
+	case exrZIPCompression:
+		return 16, nil
+	case exrZIPSCompression, exrNoCompression:
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unsupported exr compression method %d", compression)
+}
+
+func exrPixelType(name string) (int32, error) {
+	switch name {
+	case "", "half":
+		return exrHalf, nil
+	case "float":
+		return exrFloat, nil
+	}
+	return 0, fmt.Errorf("unsupported exr pixel type %s", name)
+}
+
+// passChannels defines layer channel names for each render pass and
+// which vector component they are read from.
+func passChannels(pass string) ([]string, []int) {
+	switch pass {
+	case PassDepth:
+		return []string{"Z"}, []int{0}
+	case PassOcclusion:
+		return []string{"Y"}, []int{0}
+	case PassObjectID, PassMaterialID:
+		return []string{"id"}, []int{0}
+	case PassSamples:
+		return []string{"count"}, []int{0}
+	case PassUV:
+		return []string{"U", "V"}, []int{0, 1}
+	case PassNormal, PassPosition:
+		return []string{"X", "Y", "Z"}, []int{0, 1, 2}
+	}
+	return []string{"R", "G", "B"}, []int{0, 1, 2}
+}
+
+func exrChannels(scene *Scene, pixelType int32) []exrChannel {
+	channels := make([]exrChannel, 0)
+	colorNames := []string{"R", "G", "B", "A"}
+	for i := range colorNames {
+		index := i
+		channels = append(channels, exrChannel{
+			name:      colorNames[i],
+			pixelType: pixelType,
+			value: func(x, y int) float64 {
+				return scene.Pixels[x][y].Color[index]
+			},
+		})
+	}
+	for _, pass := range scene.Config.RenderPasses {
+		names, components := passChannels(pass)
+		// Scene scale values and ids don't fit into half floats.
+		passType := pixelType
+		if pass == PassDepth || pass == PassPosition || pass == PassObjectID || pass == PassMaterialID || pass == PassSamples {
+			passType = exrFloat
+		}
+		for i := range names {
+			pass, component := pass, components[i]
+			channels = append(channels, exrChannel{
+				name:      pass + "." + names[i],
+				pixelType: passType,
+				value: func(x, y int) float64 {
+					return passValue(&scene.Pixels[x][y], pass)[component]
+				},
+			})
+		}
+	}
+	// Channels must be stored in alphabetical order.
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].name < channels[j].name
+	})
+	return channels
+}
+
+// floatToHalf converts a float32 into IEEE 754 half precision bits.
+func floatToHalf(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int32(bits>>23&0xff) - 127 + 15
+	mantissa := bits & 0x7fffff
+
+	if bits&0x7fffffff == 0 {
+		return sign
+	}
+	// NaN and infinity
+	if bits>>23&0xff == 0xff {
+		if mantissa != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+	// Too large, clamp to infinity
+	if exp >= 0x1f {
+		return sign | 0x7c00
+	}
+	// Denormalized or too small
+	if exp <= 0 {
+		if exp < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint32(14 - exp)
+		half := uint16(mantissa >> shift)
+		// round to nearest
+		if mantissa>>(shift-1)&1 == 1 {
+			half++
+		}
+		return sign | half
+	}
+	half := sign | uint16(exp)<<10 | uint16(mantissa>>13)
+	// round to nearest, may carry into the exponent which is fine
+	if mantissa&0x1000 != 0 {
+		half++
+	}
+	return half
+}
+
+// zipCompress applies EXR byte reordering and delta predictor before deflating.
+func zipCompress(data []byte) ([]byte, error) {
+	tmp := make([]byte, len(data))
+	t1 := 0
+	t2 := (len(data) + 1) / 2
+	for i := 0; i < len(data); i++ {
+		if i%2 == 0 {
+			tmp[t1] = data[i]
+			t1++
+		} else {
+			tmp[t2] = data[i]
+			t2++
+		}
+	}
+	p := int(tmp[0])
+	for i := 1; i < len(tmp); i++ {
+		d := int(tmp[i]) - p + (128 + 256)
+		p = int(tmp[i])
+		tmp[i] = byte(d)
+	}
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(tmp); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type exrHeader struct {
+	bytes.Buffer
+}
+
+func (h *exrHeader) attribute(name, kind string, value []byte) {
+	h.WriteString(name)
+	h.WriteByte(0)
+	h.WriteString(kind)
+	h.WriteByte(0)
+	_ = binary.Write(h, binary.LittleEndian, int32(len(value)))
+	h.Write(value)
+}
+
+func exrBox(xMin, yMin, xMax, yMax int) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, []int32{int32(xMin), int32(yMin), int32(xMax), int32(yMax)})
+	return buf.Bytes()
+}
+
+func exrChannelList(channels []exrChannel) []byte {
+	buf := new(bytes.Buffer)
+	for i := range channels {
+		buf.WriteString(channels[i].name)
+		buf.WriteByte(0)
+		_ = binary.Write(buf, binary.LittleEndian, channels[i].pixelType)
+		// pLinear and reserved bytes
+		buf.Write([]byte{0, 0, 0, 0})
+		// x and y sampling
+		_ = binary.Write(buf, binary.LittleEndian, []int32{1, 1})
+	}
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+func float32Bytes(values ...float32) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, values)
+	return buf.Bytes()
+}
+
+// writeEXR stores linear, unclamped pixels and the requested render passes
+// as layers of a single OpenEXR file.
+func writeEXR(scene *Scene, filename string) error {
+	if err := checkRenderPasses(scene.Config.RenderPasses); err != nil {
+		return err
+	}
+	compression, err := exrCompression(scene.Config.EXRCompression)
+	if err != nil {
+		return err
+	}
+	pixelType, err := exrPixelType(scene.Config.EXRPixelType)
+	if err != nil {
+		return err
+	}
+	img := exrImage{
+		displayWidth:  scene.frameWidth,
+		displayHeight: scene.frameHeight,
+		dataWindow:    scene.Region,
+		channels:      exrChannels(scene, pixelType),
+	}
+	return img.write(filename, compression)
+}
+
+func (img *exrImage) write(filename string, compression byte) error {
+	linesPerBlock, err := exrLinesPerBlock(compression)
+	if err != nil {
+		return err
+	}
+	channels := img.channels
+	window := img.dataWindow
+	width := window.width()
+	height := window.height()
+
+	header := exrHeader{}
+	_ = binary.Write(&header, binary.LittleEndian, uint32(exrMagic))
+	_ = binary.Write(&header, binary.LittleEndian, uint32(2))
+	header.attribute("channels", "chlist", exrChannelList(channels))
+	header.attribute("compression", "compression", []byte{compression})
+	header.attribute("dataWindow", "box2i", exrBox(window.Left, window.Top, window.Right-1, window.Bottom-1))
+	header.attribute("displayWindow", "box2i", exrBox(0, 0, img.displayWidth-1, img.displayHeight-1))
+	header.attribute("lineOrder", "lineOrder", []byte{0})
+	header.attribute("pixelAspectRatio", "float", float32Bytes(1))
+	header.attribute("screenWindowCenter", "v2f", float32Bytes(0, 0))
+	header.attribute("screenWindowWidth", "float", float32Bytes(1))
+	header.WriteByte(0)
+
+	blockCount := (height + linesPerBlock - 1) / linesPerBlock
+	blocks := make([][]byte, blockCount)
+	for b := 0; b < blockCount; b++ {
+		raw := new(bytes.Buffer)
+		for y := b * linesPerBlock; y < (b+1)*linesPerBlock && y < height; y++ {
+			for c := range channels {
+				for x := 0; x < width; x++ {
+					v := float32(channels[c].value(x, y))
+					if channels[c].pixelType == exrHalf {
+						_ = binary.Write(raw, binary.LittleEndian, floatToHalf(v))
+					} else {
+						_ = binary.Write(raw, binary.LittleEndian, v)
+					}
+				}
+			}
+		}
+		data := raw.Bytes()
+		if compression != exrNoCompression {
+			compressed, err := zipCompress(data)
+			if err != nil {
+				return err
+			}
+			// Readers take data as uncompressed when it does not get any smaller.
+			if len(compressed) < len(data) {
+				data = compressed
+			}
+		}
+		chunk := new(bytes.Buffer)
+		// Chunks start with the absolute scanline number.
+		_ = binary.Write(chunk, binary.LittleEndian, []int32{int32(window.Top + b*linesPerBlock), int32(len(data))})
+		chunk.Write(data)
+		blocks[b] = chunk.Bytes()
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.Write(header.Bytes())
+	offset := uint64(header.Len() + 8*blockCount)
+	for b := range blocks {
+		_ = binary.Write(w, binary.LittleEndian, offset)
+		offset += uint64(len(blocks[b]))
+	}
+	for b := range blocks {
+		_, _ = w.Write(blocks[b])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// halfToFloat converts IEEE 754 half precision bits into a float32.
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mantissa := uint32(h & 0x3ff)
+	switch {
+	case exp == 0 && mantissa == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// Denormalized, normalize it for float32
+		e := uint32(127 - 15 + 1)
+		for mantissa&0x400 == 0 {
+			mantissa <<= 1
+			e--
+		}
+		mantissa &= 0x3ff
+		return math.Float32frombits(sign | e<<23 | mantissa<<13)
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mantissa<<13)
+}
+
+// zipUncompress reverses zipCompress.
+func zipUncompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(tmp); i++ {
+		tmp[i] = byte(int(tmp[i-1]) + int(tmp[i]) - 128)
+	}
+	result := make([]byte, len(tmp))
+	t1 := 0
+	t2 := (len(tmp) + 1) / 2
+	for i := 0; i < len(result); i++ {
+		if i%2 == 0 {
+			result[i] = tmp[t1]
+			t1++
+		} else {
+			result[i] = tmp[t2]
+			t2++
+		}
+	}
+	return result, nil
+}
+
+func readNullString(r *bytes.Reader) (string, error) {
+	var buf bytes.Buffer
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return buf.String(), nil
+		}
+		buf.WriteByte(b)
+	}
+}
+
+func readEXRChannelList(value []byte) ([]exrChannel, error) {
+	r := bytes.NewReader(value)
+	channels := make([]exrChannel, 0)
+	for {
+		name, err := readNullString(r)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return channels, nil
+		}
+		var pixelType int32
+		var reserved [4]byte
+		var sampling [2]int32
+		if err := binary.Read(r, binary.LittleEndian, &pixelType); err != nil {
+			return nil, err
+		}
+		if _, err := r.Read(reserved[:]); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &sampling); err != nil {
+			return nil, err
+		}
+		if sampling != [2]int32{1, 1} {
+			return nil, fmt.Errorf("subsampled channel %s is not supported", name)
+		}
+		channels = append(channels, exrChannel{name: name, pixelType: pixelType})
+	}
+}
+
+func exrPixelSize(pixelType int32) int {
+	if pixelType == exrHalf {
+		return 2
+	}
+	return 4
+}
+
+// readEXR reads single part scanline images with no, ZIPS or ZIP compression.
+func readEXR(filename string) (*exrImage, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	var magic, version uint32
+	_ = binary.Read(r, binary.LittleEndian, &magic)
+	_ = binary.Read(r, binary.LittleEndian, &version)
+	if magic != exrMagic {
+		return nil, fmt.Errorf("%s is not an OpenEXR file", filename)
+	}
+	// tiled, deep and multi part flags
+	if version&0x1a00 != 0 {
+		return nil, fmt.Errorf("%s is not a single part scanline image", filename)
+	}
+
+	img := &exrImage{}
+	compression := byte(exrNoCompression)
+	var displayWindow, dataWindow [4]int32
+	for {
+		name, err := readNullString(r)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			break
+		}
+		if _, err := readNullString(r); err != nil {
+			return nil, err
+		}
+		var size int32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		if size < 0 || int(size) > r.Len() {
+			return nil, fmt.Errorf("broken attribute %s", name)
+		}
+		value := make([]byte, size)
+		_, _ = r.Read(value)
+		switch name {
+		case "channels":
+			img.channels, err = readEXRChannelList(value)
+		case "compression":
+			compression = value[0]
+		case "dataWindow":
+			err = binary.Read(bytes.NewReader(value), binary.LittleEndian, &dataWindow)
+		case "displayWindow":
+			err = binary.Read(bytes.NewReader(value), binary.LittleEndian, &displayWindow)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %s", name, err.Error())
+		}
+	}
+	linesPerBlock, err := exrLinesPerBlock(compression)
+	if err != nil {
+		return nil, err
+	}
+	img.displayWidth = int(displayWindow[2]-displayWindow[0]) + 1
+	img.displayHeight = int(displayWindow[3]-displayWindow[1]) + 1
+	img.dataWindow = Region{
+		Left:   int(dataWindow[0]),
+		Top:    int(dataWindow[1]),
+		Right:  int(dataWindow[2]) + 1,
+		Bottom: int(dataWindow[3]) + 1,
+	}
+	width := img.dataWindow.width()
+	height := img.dataWindow.height()
+	lineSize := 0
+	for i := range img.channels {
+		lineSize += width * exrPixelSize(img.channels[i].pixelType)
+	}
+
+	values := make([][]float32, len(img.channels))
+	for c := range values {
+		values[c] = make([]float32, width*height)
+	}
+	blockCount := (height + linesPerBlock - 1) / linesPerBlock
+	offsets := make([]uint64, blockCount)
+	if err := binary.Read(r, binary.LittleEndian, offsets); err != nil {
+		return nil, err
+	}
+	for b := range offsets {
+		if offsets[b]+8 > uint64(len(data)) {
+			return nil, fmt.Errorf("broken chunk offset %d", offsets[b])
+		}
+		chunk := bytes.NewReader(data[offsets[b]:])
+		var line, size int32
+		_ = binary.Read(chunk, binary.LittleEndian, &line)
+		_ = binary.Read(chunk, binary.LittleEndian, &size)
+		if size < 0 || int(size) > chunk.Len() {
+			return nil, fmt.Errorf("broken chunk at line %d", line)
+		}
+		block := make([]byte, size)
+		_, _ = chunk.Read(block)
+		first := int(line) - img.dataWindow.Top
+		lines := minInt(linesPerBlock, height-first)
+		if first < 0 || lines <= 0 {
+			return nil, fmt.Errorf("chunk line %d outside of the data window", line)
+		}
+		if len(block) < lines*lineSize {
+			block, err = zipUncompress(block)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(block) != lines*lineSize {
+			return nil, fmt.Errorf("chunk at line %d has %d bytes, expected %d", line, len(block), lines*lineSize)
+		}
+		pos := 0
+		for y := first; y < first+lines; y++ {
+			for c := range img.channels {
+				for x := 0; x < width; x++ {
+					var v float32
+					switch img.channels[c].pixelType {
+					case exrHalf:
+						v = halfToFloat(binary.LittleEndian.Uint16(block[pos:]))
+					case exrFloat:
+						v = math.Float32frombits(binary.LittleEndian.Uint32(block[pos:]))
+					default:
+						v = float32(binary.LittleEndian.Uint32(block[pos:]))
+					}
+					pos += exrPixelSize(img.channels[c].pixelType)
+					values[c][y*width+x] = v
+				}
+			}
+		}
+	}
+	for c := range img.channels {
+		channelValues := values[c]
+		img.channels[c].value = func(x, y int) float64 {
+			return float64(channelValues[y*width+x])
+		}
+	}
+	return img, nil
+}
+
+// channel returns the named channel, nil if the image doesn't have it.
+func (img *exrImage) channel(name string) *exrChannel {
+	for i := range img.channels {
+		if img.channels[i].name == name {
+			return &img.channels[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package raytracer
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFloatToHalf(t *testing.T) {
+	tests := []struct {
+		name string
+		in   float32
+		want uint16
+	}{
+		{"zero", 0, 0x0000},
+		{"negative zero", float32(math.Copysign(0, -1)), 0x8000},
+		{"one", 1, 0x3c00},
+		{"minus two", -2, 0xc000},
+		{"largest", 65504, 0x7bff},
+		{"rounds to infinity", 65520, 0x7c00},
+		{"overflow", 1e6, 0x7c00},
+		{"negative overflow", -1e6, 0xfc00},
+		{"infinity", float32(math.Inf(1)), 0x7c00},
+		{"negative infinity", float32(math.Inf(-1)), 0xfc00},
+		{"smallest normal", float32(math.Ldexp(1, -14)), 0x0400},
+		{"largest denormal", float32(math.Ldexp(1023, -24)), 0x03ff},
+		{"smallest denormal", float32(math.Ldexp(1, -24)), 0x0001},
+		{"rounds up to smallest denormal", float32(math.Ldexp(1, -25)), 0x0001},
+		{"underflow", float32(math.Ldexp(1, -26)), 0x0000},
+		{"negative underflow", float32(-math.Ldexp(1, -26)), 0x8000},
+		{"rounds to nearest", 1 + 1.0/2048, 0x3c01},
+		{"truncates below half", 1 + 1.0/4096, 0x3c00},
+	}
+	for _, tt := range tests {
+		if got := floatToHalf(tt.in); got != tt.want {
+			t.Errorf("%s: floatToHalf(%g) = %#04x, want %#04x", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFloatToHalfNaN(t *testing.T) {
+	for _, nan := range []float32{float32(math.NaN()), -float32(math.NaN())} {
+		h := floatToHalf(nan)
+		if h&0x7c00 != 0x7c00 || h&0x3ff == 0 {
+			t.Errorf("floatToHalf(NaN) = %#04x, not a NaN", h)
+		}
+		if !math.IsNaN(float64(halfToFloat(h))) {
+			t.Errorf("halfToFloat(%#04x) is not NaN", h)
+		}
+	}
+}
+
+func TestHalfRoundTrip(t *testing.T) {
+	for i := 0; i <= 0xffff; i++ {
+		h := uint16(i)
+		f := halfToFloat(h)
+		if h&0x7c00 == 0x7c00 && h&0x3ff != 0 {
+			if !math.IsNaN(float64(f)) {
+				t.Errorf("halfToFloat(%#04x) = %g, want NaN", h, f)
+			}
+			continue
+		}
+		if got := floatToHalf(f); got != h {
+			t.Errorf("floatToHalf(halfToFloat(%#04x)) = %#04x", h, got)
+		}
+	}
+}
+
+func TestHalfToFloatDenormal(t *testing.T) {
+	tests := []struct {
+		in   uint16
+		want float64
+	}{
+		{0x0001, math.Ldexp(1, -24)},
+		{0x0200, math.Ldexp(1, -15)},
+		{0x03ff, math.Ldexp(1023, -24)},
+		{0x8001, -math.Ldexp(1, -24)},
+	}
+	for _, tt := range tests {
+		if got := halfToFloat(tt.in); float64(got) != tt.want {
+			t.Errorf("halfToFloat(%#04x) = %g, want %g", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEXRWriteRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raylar-exr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	window := Region{Left: 3, Top: 2, Right: 10, Bottom: 39}
+	value := func(channel, x, y int) float64 {
+		return float64(channel*1000+y*window.width()+x) / 7
+	}
+	img := exrImage{displayWidth: 16, displayHeight: 48, dataWindow: window}
+	names := []string{"B", "G", "R", "depth.Z", "normal.X"}
+	types := []int32{exrHalf, exrHalf, exrHalf, exrFloat, exrHalf}
+	for i := range names {
+		channel := i
+		img.channels = append(img.channels, exrChannel{
+			name:      names[i],
+			pixelType: types[i],
+			value: func(x, y int) float64 {
+				return value(channel, x, y)
+			},
+		})
+	}
+
+	for _, compression := range []string{"none", "zips", "zip"} {
+		method, err := exrCompression(compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, compression+".exr")
+		if err := img.write(filename, method); err != nil {
+			t.Fatalf("%s: write: %s", compression, err)
+		}
+		read, err := readEXR(filename)
+		if err != nil {
+			t.Fatalf("%s: read: %s", compression, err)
+		}
+		if read.displayWidth != img.displayWidth || read.displayHeight != img.displayHeight {
+			t.Errorf("%s: display window %dx%d, want %dx%d", compression,
+				read.displayWidth, read.displayHeight, img.displayWidth, img.displayHeight)
+		}
+		if read.dataWindow != window {
+			t.Errorf("%s: data window %v, want %v", compression, read.dataWindow, window)
+		}
+		if len(read.channels) != len(names) {
+			t.Fatalf("%s: %d channels, want %d", compression, len(read.channels), len(names))
+		}
+		for c := range names {
+			channel := read.channel(names[c])
+			if channel == nil {
+				t.Fatalf("%s: no %s channel", compression, names[c])
+			}
+			if channel.pixelType != types[c] {
+				t.Errorf("%s: %s pixel type %d, want %d", compression, names[c], channel.pixelType, types[c])
+			}
+			for y := 0; y < window.height(); y++ {
+				for x := 0; x < window.width(); x++ {
+					want := float64(float32(value(c, x, y)))
+					if types[c] == exrHalf {
+						want = float64(halfToFloat(floatToHalf(float32(want))))
+					}
+					if got := channel.value(x, y); got != want {
+						t.Fatalf("%s: %s at %d, %d is %g, want %g", compression, names[c], x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEXRCompressionPIZ(t *testing.T) {
+	if _, err := exrCompression("piz"); err == nil {
+		t.Error("piz compression is accepted, the writer doesn't support it")
+	}
+}
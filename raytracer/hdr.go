@@ -0,0 +1,129 @@
+package raytracer
+
+/*
+Floating point image writers: Radiance HDR and Portable Float Map.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// rgbe packs a linear color into Radiance shared exponent format.
+func rgbe(c Vector) [4]byte {
+	v := math.Max(c[0], math.Max(c[1], c[2]))
+	if v < 1e-32 {
+		return [4]byte{}
+	}
+	m, e := math.Frexp(v)
+	scale := m * 256.0 / v
+	return [4]byte{
+		byte(math.Max(c[0], 0) * scale),
+		byte(math.Max(c[1], 0) * scale),
+		byte(math.Max(c[2], 0) * scale),
+		byte(e + 128),
+	}
+}
+
+// writeRLEChannel writes one channel of a scanline with Radiance run length encoding.
+func writeRLEChannel(w *bufio.Writer, data []byte) {
+	i := 0
+	for i < len(data) {
+		// Find the next run of at least 4 equal bytes.
+		runStart := i
+		runLength := 0
+		for runStart < len(data) {
+			runLength = 1
+			for runStart+runLength < len(data) && runLength < 127 && data[runStart+runLength] == data[runStart] {
+				runLength++
+			}
+			if runLength >= 4 {
+				break
+			}
+			runStart += runLength
+		}
+		if runLength < 4 {
+			runStart = len(data)
+		}
+		// Dump the bytes before the run as they are.
+		for i < runStart {
+			count := runStart - i
+			if count > 128 {
+				count = 128
+			}
+			_ = w.WriteByte(byte(count))
+			_, _ = w.Write(data[i : i+count])
+			i += count
+		}
+		if runStart < len(data) {
+			_ = w.WriteByte(byte(128 + runLength))
+			_ = w.WriteByte(data[runStart])
+			i = runStart + runLength
+		}
+	}
+}
+
+// writeHDR stores linear colors in Radiance RGBE format.
+func writeHDR(scene *Scene, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", scene.Height, scene.Width)
+
+	channels := make([][]byte, 4)
+	for c := range channels {
+		channels[c] = make([]byte, scene.Width)
+	}
+	for j := 0; j < scene.Height; j++ {
+		for i := 0; i < scene.Width; i++ {
+			p := rgbe(scene.Pixels[i][j].Color)
+			for c := range channels {
+				channels[c][i] = p[c]
+			}
+		}
+		// Run length encoding is only defined for widths between 8 and 32767.
+		if scene.Width < 8 || scene.Width > 0x7fff {
+			for i := 0; i < scene.Width; i++ {
+				_, _ = w.Write([]byte{channels[0][i], channels[1][i], channels[2][i], channels[3][i]})
+			}
+			continue
+		}
+		_, _ = w.Write([]byte{2, 2, byte(scene.Width >> 8), byte(scene.Width & 0xff)})
+		for c := range channels {
+			writeRLEChannel(w, channels[c])
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writePFM stores linear colors as a little endian Portable Float Map.
+func writePFM(scene *Scene, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	// Negative scale marks little endian data.
+	fmt.Fprintf(w, "PF\n%d %d\n-1.0\n", scene.Width, scene.Height)
+	// Scanlines go from bottom to top.
+	for j := scene.Height - 1; j >= 0; j-- {
+		for i := 0; i < scene.Width; i++ {
+			c := scene.Pixels[i][j].Color
+			_ = binary.Write(w, binary.LittleEndian, []float32{float32(c[0]), float32(c[1]), float32(c[2])})
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -2,6 +2,7 @@ package raytracer
 
 import (
 	"math"
+	"sync"
 )
 
 // Triangle definition
@@ -9,6 +10,7 @@ import (
 // in each raycast makes it harder. So we are simplifying triangle definition.
 type Triangle struct {
 	id       int64
+	objectID int64
 	P1       Vector
 	P2       Vector
 	P3       Vector
@@ -21,6 +23,7 @@ type Triangle struct {
 	Material Material
 	Photons  []Photon
 	Smooth   bool
+	motion   *triangleMotion
 }
 
 // Intersection defines the ratcast triangle intersection result.
@@ -33,6 +36,9 @@ type Intersection struct {
 	RayDir             Vector
 	Dist               float64
 	Hits               int
+	Time               float64
+	// sample dimensions of the ray, rays spawned from here continue them.
+	sample pathSample
 }
 
 func (t *Triangle) equals(dest Triangle) bool {
@@ -53,6 +59,12 @@ func (t *Triangle) getBoundingBox() BoundingBox {
 	result[1] = t.P1
 	result.extendVector(t.P2)
 	result.extendVector(t.P3)
+	if t.motion != nil {
+		// Box the whole motion so the KD-tree finds the triangle at any ray time.
+		result.extendVector(t.motion.P1)
+		result.extendVector(t.motion.P2)
+		result.extendVector(t.motion.P3)
+	}
 	return result
 }
 
@@ -65,17 +77,17 @@ func (i *Intersection) getTexCoords() Vector {
 	return tex
 }
 
-func (i *Intersection) hasBumpMap() bool {
+func (i *Intersection) hasBumpMap(scene *Scene) bool {
 	material := i.Triangle.Material
 	if material.Texture != "" {
-		if _, ok := BumpMapNormals[material.Texture]; ok {
+		if _, ok := scene.bumpMaps[material.Texture]; ok {
 			return true
 		}
 	}
 	return false
 }
 
-func (i *Intersection) getBumpNormal() Vector {
+func (i *Intersection) getBumpNormal(scene *Scene) Vector {
 	material := i.Triangle.Material
 	if material.Texture != "" {
 		// ok, we have the image. Let's calculate the pixel color;
@@ -102,10 +114,10 @@ func (i *Intersection) getBumpNormal() Vector {
 		s[0] -= float64(int64(s[0]))
 		s[1] -= float64(int64(s[1]))
 
-		pixelX := int(float64(len(BumpMapNormals[material.Texture])) * s[0])
-		pixelY := int(float64(len(BumpMapNormals[material.Texture][0])) * s[1])
+		pixelX := int(float64(len(scene.bumpMaps[material.Texture])) * s[0])
+		pixelY := int(float64(len(scene.bumpMaps[material.Texture][0])) * s[1])
 
-		bump := BumpMapNormals[material.Texture][pixelX][pixelY]
+		bump := scene.bumpMaps[material.Texture][pixelX][pixelY]
 		t := crossProduct(i.IntersectionNormal, Vector{0, -1, 0, 0})
 		if vectorLength(t) < DIFF {
 			t = crossProduct(i.IntersectionNormal, Vector{0, 0, 1, 0})
@@ -120,7 +132,7 @@ func (i *Intersection) getBumpNormal() Vector {
 	return i.IntersectionNormal
 }
 
-func (i *Intersection) getNormal() {
+func (i *Intersection) getNormal(scene *Scene) {
 	if !i.Hit {
 		return
 	}
@@ -144,26 +156,32 @@ func (i *Intersection) getNormal() {
 
 		i.IntersectionNormal = normal
 	}
-	if i.hasBumpMap() && GlobalConfig.RenderBumpMap {
-		i.IntersectionNormal = i.getBumpNormal()
+	if i.hasBumpMap(scene) && scene.Config.RenderBumpMap {
+		i.IntersectionNormal = i.getBumpNormal(scene)
 	}
 }
 
-func (i *Intersection) render(scene *Scene, depth int) Vector {
+// render the intersection color. When pixel is not nil, intermediate results
+// are recorded into it for the render passes.
+func (i *Intersection) render(scene *Scene, depth int, pixel *PixelStorage) Vector {
 	if !i.Hit {
-		if !hasEnvironmentMap {
-			return GlobalConfig.TransparentColor
+		// Camera rays outside of the lens have no direction.
+		if scene.environment == nil || i.RayDir == (Vector{}) {
+			return scene.Config.TransparentColor
 		}
 		u := math.Atan2(i.RayDir[0], i.RayDir[1])/(2*math.Pi) + 0.5
 		v := i.RayDir[2]*0.5 + 0.5
-		w := float64(len(EnvironmentMap)) - 1
-		h := float64(len(EnvironmentMap[0])) - 1
+		w := float64(len(scene.environment)) - 1
+		h := float64(len(scene.environment[0])) - 1
 		pixelX := int(w * u)
 		pixelY := int(h - h*v)
-		return EnvironmentMap[pixelX][pixelY]
+		return scene.environment[pixelX][pixelY]
+	}
+	if pixel != nil {
+		i.recordPasses(scene, pixel)
 	}
-	if depth >= GlobalConfig.MaxReflectionDepth {
-		return i.getColor()
+	if depth >= scene.Config.MaxReflectionDepth {
+		return i.getColor(scene)
 	}
 
 	// We use same samples for both color sampling as well as
@@ -174,17 +192,26 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 	light := Vector{}
 
 	// Light that reaches intersection point without any obstacles
-	if GlobalConfig.RenderLights {
+	if scene.Config.RenderLights {
 		light = i.getDirectLight(scene, depth)
 	}
+	if pixel != nil {
+		pixel.DirectLightEnergy = light
+	}
 
 	// Do we have occlusion? If so, keep in mind that, we are not actually doing a real
 	// global illumination sampling as it is way too expensive _for now_
 	// Instead, we are taking a short-cut that modern games also do, an idea by CryTek I suppose?
 	// We are doing an ambient occlusion
-	if GlobalConfig.RenderOcclusion {
-		aRate := ambientLightCalc(scene, i, samples, GlobalConfig.SamplerLimit)
-		aRate *= GlobalConfig.OcclusionRate
+	if scene.Config.RenderOcclusion {
+		aRate := ambientLightCalc(scene, i, samples, scene.Config.SamplerLimit)
+		if pixel != nil {
+			pixel.Occlusion = aRate
+		}
+		aRate *= scene.Config.OcclusionRate
+		if pixel != nil {
+			pixel.IndirectLight = Vector{aRate, aRate, aRate, 1}
+		}
 
 		// Add ambient light to direct light.
 		// In a perfect world, we should first calculate the lights then do the occlusion
@@ -198,15 +225,18 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 	}
 
 	// Get color
-	color := i.getColor()
+	color := i.getColor(scene)
 
-	if GlobalConfig.RenderAmbientColors {
+	if scene.Config.RenderAmbientColors {
 		// Get ambient colors and apply to existing color
-		aColor := ambientColor(scene, i, samples, GlobalConfig.SamplerLimit)
+		aColor := ambientColor(scene, i, samples)
+		if pixel != nil {
+			pixel.AmbientColor = aColor
+		}
 		color = Vector{
-			(color[0] * (1.0 - GlobalConfig.AmbientColorSharingRatio)) + (aColor[0] * GlobalConfig.AmbientColorSharingRatio),
-			(color[1] * (1.0 - GlobalConfig.AmbientColorSharingRatio)) + (aColor[1] * GlobalConfig.AmbientColorSharingRatio),
-			(color[2] * (1.0 - GlobalConfig.AmbientColorSharingRatio)) + (aColor[2] * GlobalConfig.AmbientColorSharingRatio),
+			(color[0] * (1.0 - scene.Config.AmbientColorSharingRatio)) + (aColor[0] * scene.Config.AmbientColorSharingRatio),
+			(color[1] * (1.0 - scene.Config.AmbientColorSharingRatio)) + (aColor[1] * scene.Config.AmbientColorSharingRatio),
+			(color[2] * (1.0 - scene.Config.AmbientColorSharingRatio)) + (aColor[2] * scene.Config.AmbientColorSharingRatio),
 			1,
 		}
 		color = limitVector(color, 1.0)
@@ -224,43 +254,29 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 		color[2] * light[2],
 		pAlpha,
 	}
-	dirs := make([]Vector, 0, int(math.Floor(i.Triangle.Material.Roughness*10)))
 
 	// END OF MAIN RENDERING OF THE INTERSECTION
 	// NOW WE DO THE TRACING PART
 
-	// Do we have a glossy (metalic) material or a glass / transmissive material?
-	if i.Triangle.Material.Glossiness > 0 || i.Triangle.Material.Transmission > 0 {
-		if i.Triangle.Material.Roughness == 0 {
-			// If we have a roughness, it means we need to sample intersection color from multiple directions to give
-			// it the roughness it needs.
-			dirs = append(dirs, i.IntersectionNormal)
-		} else {
-			numNormals := int(math.Floor(i.Triangle.Material.Roughness * 10))
-			if numNormals > 0 {
-				dirSamples := createSamples(i.IntersectionNormal, numNormals, 1-i.Triangle.Material.Roughness)
-				dirs = append(dirs, dirSamples...)
-			}
-		}
+	// Rough materials sample their intersection color from multiple directions to give
+	// it the roughness it needs.
+	numNormals := 1
+	if i.Triangle.Material.Roughness > 0 {
+		numNormals = int(math.Max(1, math.Floor(i.Triangle.Material.Roughness*10)))
 	}
 
-	if i.Triangle.Material.Glossiness > 0 && GlobalConfig.RenderReflections {
+	if i.Triangle.Material.Glossiness > 0 && scene.Config.RenderReflections {
 		// Do the reflection!
-		collColor := Vector{}
-		colChan := make(chan Vector, len(dirs))
 		// Sample from reflected directions
-		for m := range dirs {
-			go func(scene *Scene, intersection *Intersection, dir Vector, depth int, colChan chan Vector) {
-				dir = reflectVector(intersection.RayDir, dir)
-				target := raycastSceneIntersect(scene, intersection.Intersection, dir)
-				colChan <- target.render(scene, depth)
-			}(scene, i, dirs[m], depth+1, colChan)
+		reflected := []Vector{reflectVector(i.RayDir, i.IntersectionNormal)}
+		var weights []float64
+		if i.Triangle.Material.Roughness > 0 {
+			reflected, weights = scene.glossySamples(&i.sample, i.IntersectionNormal, i.RayDir, i.Triangle.Material.Roughness, numNormals)
 		}
-		for m := 0; m < len(dirs); m++ {
-			targetColor := <-colChan
-			collColor = addVector(collColor, targetColor)
+		collColor := i.traceSamples(scene, reflected, weights, depth+1, branchReflection)
+		if pixel != nil {
+			pixel.Reflection = collColor
 		}
-		collColor = scaleVector(collColor, 1.0/float64(len(dirs)))
 
 		color = Vector{
 			color[0]*(1-i.Triangle.Material.Glossiness) + collColor[0]*i.Triangle.Material.Glossiness,
@@ -269,25 +285,16 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 			1,
 		}
 	}
-	if i.Triangle.Material.Transmission > 0 && GlobalConfig.RenderRefractions {
+	if i.Triangle.Material.Transmission > 0 && scene.Config.RenderRefractions {
 		// Do the refraction!
-		collColor := Vector{}
-		colChan := make(chan Vector, len(dirs))
-		for m := range dirs {
-			go func(scene *Scene, intersection *Intersection, dir Vector, depth int, colChan chan Vector) {
-				dir = refractVector(
-					intersection.RayDir,
-					intersection.IntersectionNormal,
-					intersection.Triangle.Material.IndexOfRefraction)
-				target := raycastSceneIntersect(scene, intersection.Intersection, dir)
-				colChan <- target.render(scene, depth)
-			}(scene, i, dirs[m], depth+1, colChan)
+		refracted := make([]Vector, numNormals)
+		for m := range refracted {
+			refracted[m] = refractVector(i.RayDir, i.IntersectionNormal, i.Triangle.Material.IndexOfRefraction)
 		}
-		for m := 0; m < len(dirs); m++ {
-			targetColor := <-colChan
-			collColor = addVector(collColor, targetColor)
+		collColor := i.traceSamples(scene, refracted, nil, depth+1, branchRefraction)
+		if pixel != nil {
+			pixel.Refraction = collColor
 		}
-		collColor = scaleVector(collColor, 1.0/float64(len(dirs)))
 		trans := i.Triangle.Material.Transmission * (1 - i.Triangle.Material.Roughness)
 
 		color = Vector{
@@ -297,18 +304,55 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 			1,
 		}
 	}
-	// When light is too shiny, we have to limit color to white as it can't exceed white.
-	color = limitVector(color, 1)
-
+	// Color is kept as linear radiance here, it is only limited to white
+	// when it is written to a low dynamic range image.
 	return color
 }
 
+// traceSamples renders the rays from the intersection into dirs and averages
+// their colors times weights in order, so the result doesn't depend on
+// scheduling. Nil weights weigh every ray 1.
+func (i *Intersection) traceSamples(scene *Scene, dirs []Vector, weights []float64, depth, branch int) Vector {
+	colors := make([]Vector, len(dirs))
+	var wg sync.WaitGroup
+	for m := range dirs {
+		wg.Add(1)
+		go func(dir Vector, sample pathSample, color *Vector) {
+			defer wg.Done()
+			target := raycastSceneIntersect(scene, i.Intersection, dir, i.Time)
+			target.sample = sample
+			*color = target.render(scene, depth, nil)
+		}(dirs[m], i.sample.child(branch, m), &colors[m])
+	}
+	wg.Wait()
+	result := Vector{}
+	for m := range colors {
+		if weights != nil {
+			colors[m] = scaleVector(colors[m], weights[m])
+		}
+		result = addVector(result, colors[m])
+	}
+	return scaleVector(result, 1.0/float64(len(dirs)))
+}
+
+// recordPasses stores surface information of the intersection for the render passes.
+func (i *Intersection) recordPasses(scene *Scene, pixel *PixelStorage) {
+	pixel.Normal = i.IntersectionNormal
+	pixel.Position = i.Intersection
+	pixel.Albedo = i.getColor(scene)
+	pixel.ObjectID = i.Triangle.objectID
+	pixel.MaterialID = i.Triangle.Material.id
+	if i.Triangle.T1 != i.Triangle.T2 || i.Triangle.T1 != i.Triangle.T3 {
+		pixel.UV = i.getTexCoords()
+	}
+}
+
 func (i *Intersection) getDirectLight(scene *Scene, depth int) Vector {
 	return calculateTotalLight(scene, i, 0)
 }
 
-func (i *Intersection) getColor() Vector {
-	if !GlobalConfig.RenderColors {
+func (i *Intersection) getColor(scene *Scene) Vector {
+	if !scene.Config.RenderColors {
 		return Vector{
 			1, 1, 1, 1,
 		}
@@ -319,7 +363,7 @@ func (i *Intersection) getColor() Vector {
 	if material.Texture == "" {
 		return result
 	}
-	if _, ok := Images[material.Texture]; ok {
+	if _, ok := scene.images[material.Texture]; ok {
 		// ok, we have the image. Let's calculate the pixel color;
 		s := i.getTexCoords()
 		// get image size
@@ -345,9 +389,9 @@ func (i *Intersection) getColor() Vector {
 		s[0] -= float64(int64(s[0]))
 		s[1] -= float64(int64(s[1]))
 
-		pixelX := int(float64(len(Images[material.Texture])) * s[0])
-		pixelY := int(float64(len(Images[material.Texture][0])) * s[1])
-		result = Images[material.Texture][pixelX][pixelY]
+		pixelX := int(float64(len(scene.images[material.Texture])) * s[0])
+		pixelY := int(float64(len(scene.images[material.Texture][0])) * s[1])
+		result = scene.images[material.Texture][pixelX][pixelY]
 	}
 	return result
 }
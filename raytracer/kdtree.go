@@ -93,10 +93,16 @@ func (n *Node) midPoint() Vector {
 	return scaleVector(mid, 1.0/float64(len(n.Triangles)))
 }
 
-func generateNode(tris *[]Triangle, depth int) (result Node) {
-	totalNodes++
-	if depth > maxDepth {
-		maxDepth = depth
+// treeStats counts KD-tree nodes while building.
+type treeStats struct {
+	nodes    int
+	maxDepth int
+}
+
+func generateNode(tris *[]Triangle, depth int, stats *treeStats) (result Node) {
+	stats.nodes++
+	if depth > stats.maxDepth {
+		stats.maxDepth = depth
 	}
 	result.Triangles = *tris
 	result.TriangleCount = len(result.Triangles)
@@ -156,8 +162,8 @@ func generateNode(tris *[]Triangle, depth int) (result Node) {
 	}
 
 	if ratio && depth < 50 {
-		leftNode := generateNode(&leftTris, depth+1)
-		rightNode := generateNode(&rightTris, depth+1)
+		leftNode := generateNode(&leftTris, depth+1, stats)
+		rightNode := generateNode(&rightTris, depth+1, stats)
 		result.Left = &leftNode
 		result.Right = &rightNode
 		result.Triangles = nil
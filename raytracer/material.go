@@ -2,18 +2,11 @@ package raytracer
 
 import (
 	"image"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-// Images map to hold image data in memory for repeating images.
-var Images map[string][][]Vector
-
-// BumpMapNormals cache to hold bump map information in memory.
-var BumpMapNormals map[string][][]Vector
-
 type indice [4]int64
 
 // Material definition.
@@ -27,79 +20,103 @@ type Material struct {
 	Roughness         float64  `json:"roughness"`
 	Light             bool     `json:"light"`
 	LightStrength     float64  `json:"light_strength"`
+	id                int64
 }
 
-func loadImage(scenePath, texture string) (imageHasAlpha bool) {
+// loadImage keeps texture pixels in the scene for repeating images.
+func (s *Scene) loadImage(scenePath, texture string) error {
 	textureName := texture
 	_, err := os.Stat(texture)
 	if os.IsNotExist(err) {
 		texture = filepath.Join(scenePath, texture)
 	}
+	if err := s.checkRoot(texture); err != nil {
+		return &TextureError{Texture: texture, Err: err}
+	}
 	imageFile, err := os.Open(texture)
 	if err != nil {
-		log.Printf("Material texture [%s] can't be opened\n", texture)
-		imageFile.Close() // defer has over-head
-		return
+		return &TextureError{Texture: texture, Err: err}
 	}
 	src, _, err := image.Decode(imageFile)
+	imageFile.Close()
 	if err != nil {
-		log.Printf("Error reading image file [%s]: [%s]\n", texture, err.Error())
-		imageFile.Close()
-		return
+		return &TextureError{Texture: texture, Err: err}
 	}
 
+	imageHasAlpha := false
+
 	imgBounds := src.Bounds().Max
-	Images[textureName] = make([][]Vector, imgBounds.X)
+	s.images[textureName] = make([][]Vector, imgBounds.X)
 	for i := 0; i < imgBounds.X; i++ {
-		Images[textureName][i] = make([]Vector, imgBounds.Y)
+		s.images[textureName][i] = make([]Vector, imgBounds.Y)
 		for j := 0; j < imgBounds.Y; j++ {
 			r, g, b, a := src.At(i, j).RGBA()
 			r, g, b, a = r>>8, g>>8, b>>8, a>>8
 
+			// Color images are sRGB encoded, we render in linear space.
 			result := Vector{
-				float64(r) / 255,
-				float64(g) / 255,
-				float64(b) / 255,
+				srgbToLinearTable[r],
+				srgbToLinearTable[g],
+				srgbToLinearTable[b],
 				float64(a) / 255,
 			}
 			if result[3] < 1 {
 				imageHasAlpha = true
 			}
 
-			Images[textureName][i][j] = result
+			s.images[textureName][i][j] = result
 		}
 	}
-	imageFile.Close()
 
-	log.Printf("Image %s loaded: Alpha %t", texture, imageHasAlpha)
-	return imageHasAlpha
+	s.logf("Image %s loaded: Alpha %t", texture, imageHasAlpha)
+	return nil
+}
+
+// checkRoot refuses files outside the scene root, scenes without one can use any file.
+func (s *Scene) checkRoot(filename string) error {
+	if s.root == "" {
+		return nil
+	}
+	return insideRoot(s.root, filename)
 }
 
-func loadBumpMap(scenePath, texture string) {
+// bumpMapFilename is the bump map image that belongs to the texture.
+func bumpMapFilename(texture string) string {
 	ext := filepath.Ext(texture)
 	base := strings.TrimSuffix(texture, ext)
 	texturePath := filepath.Dir(texture)
-	bumpTexture := filepath.Join(texturePath, base+"_bump"+ext)
+	return filepath.Join(texturePath, base+"_bump"+ext)
+}
+
+// loadBumpMap keeps bump map normals of the texture in the scene.
+// Bump maps are optional, textures without one are fine.
+func (s *Scene) loadBumpMap(scenePath, texture string) error {
+	bumpTexture := bumpMapFilename(texture)
 	_, err := os.Stat(bumpTexture)
 	if os.IsNotExist(err) {
 		bumpTexture = filepath.Join(scenePath, bumpTexture)
 	}
 	imageFile, err := os.Open(bumpTexture)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		imageFile.Close() // defer has over-head
-		return
+		return &TextureError{Texture: bumpTexture, Err: err}
+	}
+	if err := s.checkRoot(bumpTexture); err != nil {
+		imageFile.Close()
+		return &TextureError{Texture: bumpTexture, Err: err}
 	}
 	src, _, err := image.Decode(imageFile)
+	imageFile.Close()
 	if err != nil {
-		log.Printf("Error reading image file [%s]: [%s]\n", texture, err.Error())
-		imageFile.Close()
-		return
+		return &TextureError{Texture: bumpTexture, Err: err}
 	}
-	log.Printf("Image Bump Map %s loaded", bumpTexture)
+	s.logf("Image Bump Map %s loaded", bumpTexture)
 	imgBounds := src.Bounds().Max
-	BumpMapNormals[texture] = make([][]Vector, imgBounds.X)
+	s.bumpMaps[texture] = make([][]Vector, imgBounds.X)
 	for i := 0; i < imgBounds.X; i++ {
-		BumpMapNormals[texture][i] = make([]Vector, imgBounds.Y)
+		s.bumpMaps[texture][i] = make([]Vector, imgBounds.Y)
 		for j := 0; j < imgBounds.Y; j++ {
 			r, g, b, _ := src.At(i, j).RGBA()
 			r, g, b = r>>8, g>>8, b>>8
@@ -111,8 +128,8 @@ func loadBumpMap(scenePath, texture string) {
 				1,
 			})
 
-			BumpMapNormals[texture][i][j] = normalizeVector(subVector(scaleVector(bump, 2), Vector{1, 1, 1, 0}))
+			s.bumpMaps[texture][i][j] = normalizeVector(subVector(scaleVector(bump, 2), Vector{1, 1, 1, 0}))
 		}
 	}
-	imageFile.Close()
+	return nil
 }
@@ -132,6 +132,26 @@ func invertMatrix(m Matrix) Matrix {
 	return scaleMatrix(m2, 1/det)
 }
 
+// normalMatrix transforms normals like m transforms points. It is the
+// inverse transpose of the upper 3x3 of m, so normals stay perpendicular
+// to surfaces under non-uniform scale.
+func normalMatrix(m Matrix) Matrix {
+	linear := identityHmgMatrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			linear[i][j] = m[i][j]
+		}
+	}
+	inverse := invertMatrix(linear)
+	result := identityHmgMatrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			result[i][j] = inverse[j][i]
+		}
+	}
+	return result
+}
+
 // multiplyMatrix operation.
 func multiplyMatrix(m1, m2 Matrix) Matrix {
 	var result Matrix
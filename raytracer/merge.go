@@ -0,0 +1,133 @@
+package raytracer
+
+/*
+Merge stitches region renders back into a full frame. EXR regions come
+from their data window, other images from the .region.json file written
+next to them.
+*/
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+)
+
+// Merge region renders into a full frame output, messages go to the
+// reporter or the terminal if it is nil.
+func Merge(output, format string, inputs []string, reporter Reporter) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("no region renders to merge")
+	}
+	format, err := outputFormat(output, format)
+	if err != nil {
+		return err
+	}
+	if reporter == nil {
+		reporter = NewTerminalReporter()
+	}
+	switch format {
+	case FormatEXR:
+		return mergeEXR(output, inputs, reporter)
+	case FormatPNG, FormatPNG16:
+		return mergePNG(output, format, inputs, reporter)
+	}
+	return fmt.Errorf("can't merge into %s, use png or exr", format)
+}
+
+func mergeEXR(output string, inputs []string, reporter Reporter) error {
+	images := make([]*exrImage, len(inputs))
+	for i := range inputs {
+		img, err := readEXR(inputs[i])
+		if err != nil {
+			return fmt.Errorf("%s: %s", inputs[i], err.Error())
+		}
+		images[i] = img
+	}
+	width := images[0].displayWidth
+	height := images[0].displayHeight
+	merged := exrImage{
+		displayWidth:  width,
+		displayHeight: height,
+		dataWindow:    Region{Left: 0, Top: 0, Right: width, Bottom: height},
+	}
+	for _, channel := range images[0].channels {
+		values := make([]float64, width*height)
+		for i, img := range images {
+			if img.displayWidth != width || img.displayHeight != height {
+				return fmt.Errorf("%s is %dx%d, expected %dx%d", inputs[i], img.displayWidth, img.displayHeight, width, height)
+			}
+			source := img.channel(channel.name)
+			if source == nil {
+				return fmt.Errorf("%s has no %s channel", inputs[i], channel.name)
+			}
+			window := img.dataWindow
+			for y := 0; y < window.height(); y++ {
+				for x := 0; x < window.width(); x++ {
+					values[(y+window.Top)*width+x+window.Left] = source.value(x, y)
+				}
+			}
+		}
+		merged.channels = append(merged.channels, exrChannel{
+			name:      channel.name,
+			pixelType: channel.pixelType,
+			value: func(x, y int) float64 {
+				return values[y*width+x]
+			},
+		})
+	}
+	compression, err := exrCompression(DEFAULT.EXRCompression)
+	if err != nil {
+		return err
+	}
+	reporter.Message(fmt.Sprintf("Writing merged exr output to %s", output))
+	return merged.write(output, compression)
+}
+
+func mergePNG(output, format string, inputs []string, reporter Reporter) error {
+	var merged draw.Image
+	var frameWidth, frameHeight int
+	for _, input := range inputs {
+		info, err := readRegionInfo(input)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		src, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", input, err.Error())
+		}
+		if merged == nil {
+			frameWidth, frameHeight = info.FrameWidth, info.FrameHeight
+			merged = newMergeImage(src, format, frameWidth, frameHeight)
+		}
+		if info.FrameWidth != frameWidth || info.FrameHeight != frameHeight {
+			return fmt.Errorf("%s is a region of %dx%d, expected %dx%d", input, info.FrameWidth, info.FrameHeight, frameWidth, frameHeight)
+		}
+		from := src.Bounds().Min
+		if !info.Crop {
+			// Border renders have the region in place.
+			from = from.Add(image.Pt(info.Left, info.Top))
+		}
+		draw.Draw(merged, image.Rect(info.Left, info.Top, info.Right, info.Bottom), src, from, draw.Src)
+	}
+	reporter.Message(fmt.Sprintf("Writing merged png output to %s", output))
+	return writePNG(output, merged)
+}
+
+// newMergeImage keeps 16 bits per channel if asked for or inputs have it.
+func newMergeImage(src image.Image, format string, width, height int) draw.Image {
+	bounds := image.Rect(0, 0, width, height)
+	switch src.(type) {
+	case *image.NRGBA64, *image.RGBA64, *image.Gray16:
+		return image.NewNRGBA64(bounds)
+	}
+	if format == FormatPNG16 {
+		return image.NewNRGBA64(bounds)
+	}
+	return image.NewNRGBA(bounds)
+}
@@ -0,0 +1,106 @@
+package raytracer
+
+/*
+Motion blur. Camera rays get a time within the shutter interval, 0 is
+shutter open and 1 is shutter close. Triangles of objects moving while
+the shutter is open keep their shutter close positions too and are
+interpolated to the ray time when tested. Their bounding boxes cover the
+whole motion so the KD-tree finds them at any time. Moving cameras are
+interpolated between their shutter open and close poses.
+*/
+
+// shutterCenter is the time of rays that don't sample the shutter.
+const shutterCenter = 0.5
+
+// triangleMotion is the triangle at shutter close.
+type triangleMotion struct {
+	P1 Vector
+	P2 Vector
+	P3 Vector
+	N1 Vector
+	N2 Vector
+	N3 Vector
+}
+
+// cameraMotion is the camera pose at shutter open and close.
+type cameraMotion struct {
+	position [2]Vector
+	target   [2]Vector
+	fov      [2]float64
+}
+
+// rayTime picks the shutter time of a camera ray.
+func (s *Scene) rayTime(p pathSample) float64 {
+	if !s.Config.MotionBlur {
+		return shutterCenter
+	}
+	time, _ := s.cameraPoint(p, dimensionTime)
+	return time
+}
+
+// shutterFrames are the frames the shutter opens and closes at, centered on the current frame.
+func (s *Scene) shutterFrames() (float64, float64) {
+	if !s.Config.MotionBlur {
+		return s.frame, s.frame
+	}
+	half := s.Config.Shutter / 2
+	return s.frame - half, s.frame + half
+}
+
+// shutterMatrices are the object world matrices at shutter open and close.
+func (s *Scene) shutterMatrices(o *Object) (Matrix, Matrix) {
+	start, end := s.shutterFrames()
+	if start == end || !o.animated() {
+		m := o.worldMatrix(s.frame)
+		return m, m
+	}
+	return o.worldMatrix(start), o.worldMatrix(end)
+}
+
+// positionsAt returns the moving triangle corners at time.
+func (t *Triangle) positionsAt(time float64) (Vector, Vector, Vector) {
+	return combine(t.P1, t.motion.P1, 1-time, time),
+		combine(t.P2, t.motion.P2, 1-time, time),
+		combine(t.P3, t.motion.P3, 1-time, time)
+}
+
+// at returns the moving triangle at time.
+func (t *Triangle) at(time float64) Triangle {
+	moved := *t
+	moved.motion = nil
+	moved.P1, moved.P2, moved.P3 = t.positionsAt(time)
+	moved.N1 = normalizeVector(combine(t.N1, t.motion.N1, 1-time, time))
+	moved.N2 = normalizeVector(combine(t.N2, t.motion.N2, 1-time, time))
+	moved.N3 = normalizeVector(combine(t.N3, t.motion.N3, 1-time, time))
+	return moved
+}
+
+// shutterMotion poses a copy of the camera at shutter open and close,
+// nil if the camera doesn't move while the shutter is open.
+func (c *Camera) shutterMotion(start, end float64) *cameraMotion {
+	if start == end {
+		return nil
+	}
+	posed := *c
+	motion := cameraMotion{}
+	for k, frame := range [2]float64{start, end} {
+		posed.pose(frame)
+		motion.position[k] = posed.Position
+		motion.target[k] = posed.Target
+		motion.fov[k] = posed.Fov
+	}
+	if motion.position[0] == motion.position[1] && motion.target[0] == motion.target[1] && motion.fov[0] == motion.fov[1] {
+		return nil
+	}
+	return &motion
+}
+
+// at returns the camera position, view and projection at shutter time.
+func (m *cameraMotion) at(c *Camera, time float64) (Vector, Matrix, Matrix) {
+	position := combine(m.position[0], m.position[1], 1-time, time)
+	target := combine(m.target[0], m.target[1], 1-time, time)
+	fov := m.fov[0]*(1-time) + m.fov[1]*time
+	view := viewMatrix(position, target, c.Up)
+	projection := perspectiveProjection(fov, float64(c.width)/float64(c.height), c.Near, c.Far)
+	return position, view, projection
+}
@@ -1,10 +1,6 @@
 package raytracer
 
-import "log"
-
-var totalNodes = 0
-var maxDepth = 0
-var idCounter int64 = 0
+import "sort"
 
 // Object definition.
 type Object struct {
@@ -14,18 +10,60 @@ type Object struct {
 	Matrix    Matrix              `json:"matrix"`
 	Materials map[string]Material `json:"materials"`
 	Children  map[string]*Object  `json:"children"`
+	Keyframes []ObjectKeyframe    `json:"keyframes"`
 	Triangles []Triangle
 	Root      Node
 	radius    float64
+	id        int64
+	// Animation state: matrix from the scene file, parents after
+	// flattening, world matrices at shutter open and close and
+	// untransformed triangles.
+	localMatrix    Matrix
+	parents        []*Object
+	world          Matrix
+	worldEnd       Matrix
+	localTriangles []Triangle
+}
+
+// checkIndices makes sure faces only point to existing vertices, normals and texture coordinates.
+func (o *Object) checkIndices(name string) error {
+	for matName, mat := range o.Materials {
+		for _, face := range mat.Indices {
+			for _, index := range face[:3] {
+				if index < 0 || index >= int64(len(o.Vertices)) {
+					return &MeshIndexError{Object: name, Material: matName, Kind: "vertex", Index: index, Count: len(o.Vertices)}
+				}
+				if index >= int64(len(o.Normals)) {
+					return &MeshIndexError{Object: name, Material: matName, Kind: "normal", Index: index, Count: len(o.Normals)}
+				}
+				if len(o.TexCoords) > 0 && index >= int64(len(o.TexCoords)) {
+					return &MeshIndexError{Object: name, Material: matName, Kind: "texture coordinate", Index: index, Count: len(o.TexCoords)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// materialNames of the object sorted, so triangles are always built in the same order.
+func (o *Object) materialNames() []string {
+	names := make([]string, 0, len(o.Materials))
+	for name := range o.Materials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // UnifyTriangles of the object for faster processing.
-func (o *Object) UnifyTriangles() {
-	for matName := range o.Materials {
+// Triangle ids continue from lastID, which is left at the last one given.
+func (o *Object) UnifyTriangles(lastID *int64) {
+	for _, matName := range o.materialNames() {
 		for indice := range o.Materials[matName].Indices {
 			triangle := Triangle{}
-			triangle.id = idCounter + 1
-			idCounter++
+			*lastID++
+			triangle.id = *lastID
+			triangle.objectID = o.id
 			face := o.Materials[matName].Indices[indice]
 			triangle.P1 = o.Vertices[face[0]]
 			triangle.P2 = o.Vertices[face[1]]
@@ -46,15 +84,53 @@ func (o *Object) UnifyTriangles() {
 			o.Triangles = append(o.Triangles, triangle)
 		}
 	}
-	log.Printf("Loaded object with %d triangles", len(o.Triangles))
 	o.Vertices = nil
 	o.Normals = nil
 	o.TexCoords = nil
 }
 
+// transformTriangles places the object triangles with its world matrix.
+// Objects moving while the shutter is open also get their shutter close positions.
+func (o *Object) transformTriangles() {
+	source := o.Triangles
+	if o.localTriangles != nil {
+		source = o.localTriangles
+	}
+	var motions []triangleMotion
+	if o.worldEnd != o.world {
+		motions = make([]triangleMotion, len(source))
+	}
+	normals := normalMatrix(o.world)
+	normalsEnd := normalMatrix(o.worldEnd)
+	for i := range source {
+		t := source[i]
+		t.motion = nil
+		if motions != nil {
+			motions[i] = triangleMotion{
+				P1: vectorTransform(t.P1, o.worldEnd),
+				P2: vectorTransform(t.P2, o.worldEnd),
+				P3: vectorTransform(t.P3, o.worldEnd),
+				N1: normalizeVector(vectorTransform(t.N1, normalsEnd)),
+				N2: normalizeVector(vectorTransform(t.N2, normalsEnd)),
+				N3: normalizeVector(vectorTransform(t.N3, normalsEnd)),
+			}
+			t.motion = &motions[i]
+		}
+		t.P1 = vectorTransform(t.P1, o.world)
+		t.P2 = vectorTransform(t.P2, o.world)
+		t.P3 = vectorTransform(t.P3, o.world)
+		t.N1 = normalizeVector(vectorTransform(t.N1, normals))
+		t.N2 = normalizeVector(vectorTransform(t.N2, normals))
+		t.N3 = normalizeVector(vectorTransform(t.N3, normals))
+		o.Triangles[i] = t
+	}
+}
+
 // KDTree Building.
-func (o *Object) KDTree() {
-	o.Root = generateNode(&o.Triangles, 0)
+func (o *Object) KDTree() treeStats {
+	stats := treeStats{}
+	o.Root = generateNode(&o.Triangles, 0, &stats)
+	return stats
 }
 
 func (o *Object) fixW() {
@@ -0,0 +1,153 @@
+package raytracer
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output formats, picked by file extension unless set explicitly.
+const (
+	FormatPNG    = "png"
+	FormatPNG16  = "png16"
+	FormatTIFF   = "tiff"
+	FormatEXR    = "exr"
+	FormatHDR    = "hdr"
+	FormatPFM    = "pfm"
+	formatNotSet = ""
+)
+
+// outputFormat returns the format to use for given filename.
+func outputFormat(filename, format string) (string, error) {
+	if format != formatNotSet {
+		switch format {
+		case FormatPNG, FormatPNG16, FormatTIFF, FormatEXR, FormatHDR, FormatPFM:
+			return format, nil
+		}
+		return "", fmt.Errorf("unknown output format %s", format)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".exr":
+		return FormatEXR, nil
+	case ".hdr":
+		return FormatHDR, nil
+	case ".pfm":
+		return FormatPFM, nil
+	case ".tif", ".tiff":
+		return FormatTIFF, nil
+	}
+	return FormatPNG, nil
+}
+
+// writeOutput encodes rendered pixels into filename, cube maps may be split into files per face.
+func writeOutput(scene *Scene, filename string) error {
+	// Metered once, so cube faces get the same exposure.
+	if err := scene.meterExposure(); err != nil {
+		return err
+	}
+	if scene.separateCubeFaces() {
+		return writeCubeFaces(scene, filename)
+	}
+	return writeImage(scene, filename)
+}
+
+// writeImage encodes rendered pixels into filename.
+func writeImage(scene *Scene, filename string) error {
+	format, err := outputFormat(filename, scene.OutputFormat)
+	if err != nil {
+		return err
+	}
+	scene.logf("Writing %s output to %s", format, filename)
+	// EXR keeps the region in its data window, other formats get the
+	// region written next to them so they can be merged.
+	if format != FormatEXR && !scene.fullFrame() {
+		if err := writeRegionInfo(scene, filename); err != nil {
+			return err
+		}
+		if !scene.Crop {
+			scene = scene.framedScene()
+		}
+	}
+	switch format {
+	case FormatEXR:
+		// Render passes go into the same file as layers.
+		return writeEXR(scene, filename)
+	case FormatHDR:
+		err = writeHDR(scene, filename)
+	case FormatPFM:
+		err = writePFM(scene, filename)
+	default:
+		err = writeDisplayImage(scene, filename, format)
+	}
+	if err != nil {
+		return err
+	}
+	return writeRenderPasses(scene, filename)
+}
+
+// writeDisplayImage writes low dynamic range formats through the display transform.
+func writeDisplayImage(scene *Scene, filename, format string) error {
+	transform, err := newDisplayTransform(scene)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case FormatTIFF:
+		return writeTIFF16(filename, colorImage16(scene, transform))
+	case FormatPNG16:
+		return writePNG(filename, colorImage16(scene, transform))
+	}
+	return writePNG(filename, colorImage(scene, transform))
+}
+
+// colorImage maps the rendered colors into an 8-bit image.
+func colorImage(scene *Scene, transform *displayTransform) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, scene.Width, scene.Height))
+	for i := 0; i < scene.Width; i++ {
+		for j := 0; j < scene.Height; j++ {
+			pcolor := transform.apply(scene.Pixels[i][j].Color)
+			img.Set(i, j, color.RGBA{
+				R: uint8(math.Floor(pcolor[0] * 255)),
+				G: uint8(math.Floor(pcolor[1] * 255)),
+				B: uint8(math.Floor(pcolor[2] * 255)),
+				A: uint8(math.Floor(pcolor[3] * 255)),
+			})
+		}
+	}
+	return img
+}
+
+// colorImage16 maps the rendered colors into an image with 16 bits per channel.
+func colorImage16(scene *Scene, transform *displayTransform) *image.NRGBA64 {
+	img := image.NewNRGBA64(image.Rect(0, 0, scene.Width, scene.Height))
+	for i := 0; i < scene.Width; i++ {
+		for j := 0; j < scene.Height; j++ {
+			pcolor := transform.apply(scene.Pixels[i][j].Color)
+			img.SetNRGBA64(i, j, color.NRGBA64{
+				R: uint16(math.Round(pcolor[0] * 65535)),
+				G: uint16(math.Round(pcolor[1] * 65535)),
+				B: uint16(math.Round(pcolor[2] * 65535)),
+				A: uint16(math.Round(pcolor[3] * 65535)),
+			})
+		}
+	}
+	return img
+}
+
+func writePNG(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
@@ -10,15 +10,21 @@ type Photon struct {
 	Intensity float64
 }
 
-// trace a photon's path.
-func tracePhoton(scene *Scene, photon *Photon, depth int) {
+// photonHit is a photon to store on the triangle it landed on.
+type photonHit struct {
+	triangle *Triangle
+	photon   Photon
+}
+
+// trace a photon's path, photons landing on diffuse surfaces are added to hits.
+func tracePhoton(scene *Scene, photon *Photon, depth int, hits *[]photonHit) {
 	if photon.Intensity < DIFF {
 		return
 	}
-	if depth > GlobalConfig.MaxReflectionDepth {
+	if depth > scene.Config.MaxReflectionDepth {
 		return
 	}
-	hit := raycastSceneIntersect(scene, photon.Location, photon.Direction)
+	hit := raycastSceneIntersect(scene, photon.Location, photon.Direction, shutterCenter)
 	if !hit.Hit {
 		return
 	}
@@ -38,14 +44,11 @@ func tracePhoton(scene *Scene, photon *Photon, depth int) {
 	}
 
 	if hit.Triangle.Material.Glossiness == 0 && hit.Triangle.Material.Transmission == 0 {
-		if hit.Triangle.Photons == nil {
-			hit.Triangle.Photons = make([]Photon, 0)
-		}
-		hit.Triangle.Photons = append(hit.Triangle.Photons, Photon{
+		*hits = append(*hits, photonHit{triangle: hit.Triangle, photon: Photon{
 			Location:  hit.Intersection,
 			Color:     trace,
 			Direction: photon.Direction,
-		})
+		}})
 	}
 
 	if hit.Triangle.Material.Glossiness > 0 {
@@ -56,7 +59,7 @@ func tracePhoton(scene *Scene, photon *Photon, depth int) {
 			Color:     photon.Color,
 			Intensity: photon.Intensity * hit.Triangle.Material.Glossiness,
 		}
-		tracePhoton(scene, &reflectedPhoton, depth+1)
+		tracePhoton(scene, &reflectedPhoton, depth+1, hits)
 	}
 	if hit.Triangle.Material.Transmission > 0 {
 		refract := refractVector(photon.Direction, hit.IntersectionNormal, hit.Triangle.Material.IndexOfRefraction)
@@ -66,6 +69,6 @@ func tracePhoton(scene *Scene, photon *Photon, depth int) {
 			Color:     photon.Color,
 			Intensity: photon.Intensity * hit.Triangle.Material.Transmission,
 		}
-		tracePhoton(scene, &refractedPhoton, depth+1)
+		tracePhoton(scene, &refractedPhoton, depth+1, hits)
 	}
 }
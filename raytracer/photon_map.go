@@ -1,37 +1,49 @@
 package raytracer
 
 import (
-	"log"
-	"math"
+	"context"
 	"runtime"
 	"sync"
 )
 
-func buildPhotonMap(scene *Scene) {
-	log.Printf("Analysing scene for caustic surfaces")
+// photonBatchSize is the number of sample locations traced together.
+const photonBatchSize = 256
+
+func buildPhotonMap(ctx context.Context, scene *Scene) error {
+	scene.logf("Analysing scene for caustic surfaces")
 	causticSampleLocations := make([]Vector, 0)
 
 	for tri := range scene.MasterObject.Triangles {
 		if scene.MasterObject.Triangles[tri].Material.Glossiness > 0 || scene.MasterObject.Triangles[tri].Material.Transmission > 0 {
-			locations := sampleTriangle(scene.MasterObject.Triangles[tri], GlobalConfig.CausticsSamplerLimit)
+			seed := scene.random(streamCaustics, uint64(tri))
+			locations := sampleTriangle(scene.sampler, seed.next(), scene.MasterObject.Triangles[tri], scene.Config.CausticsSamplerLimit)
 			causticSampleLocations = append(causticSampleLocations, locations...)
 		}
 	}
 
-	log.Printf("Found %d sample photons", len(causticSampleLocations))
+	scene.logf("Found %d sample photons", len(causticSampleLocations))
+	// Batches don't depend on the CPU count and their photons are stored
+	// in batch order, so photon maps are the same on every machine.
+	batchCount := (len(causticSampleLocations) + photonBatchSize - 1) / photonBatchSize
 	for i := range scene.Lights {
+		light := &scene.Lights[i]
+		hits := make([][]photonHit, batchCount)
+		slots := make(chan bool, runtime.NumCPU())
 		var wg sync.WaitGroup
-		workCount := runtime.NumCPU() * 8
-		batchSize := int(math.Floor(float64(len(causticSampleLocations)) / float64(workCount)))
-		for k := 0; k < workCount-1; k++ {
-			from := batchSize * k
-			to := batchSize * (k + 1)
+		for k := 0; k < batchCount; k++ {
+			if err := ctx.Err(); err != nil {
+				wg.Wait()
+				return err
+			}
+			from := photonBatchSize * k
+			to := from + photonBatchSize
 			if to > len(causticSampleLocations) {
 				to = len(causticSampleLocations)
 			}
-			sample := causticSampleLocations[from:to]
+			slots <- true
 			wg.Add(1)
-			go func(scene *Scene, samples []Vector, light *Light, wg *sync.WaitGroup) {
+			go func(samples []Vector, hits *[]photonHit) {
+				defer wg.Done()
 				for sampleIndex := range samples {
 					dir := normalizeVector(subVector(samples[sampleIndex], light.Position))
 					photon := Photon{
@@ -40,12 +52,18 @@ func buildPhotonMap(scene *Scene) {
 						Direction: dir,
 						Intensity: light.LightStrength,
 					}
-					tracePhoton(scene, &photon, 0)
+					tracePhoton(scene, &photon, 0, hits)
 				}
-				wg.Done()
-			}(scene, sample, &scene.Lights[i], &wg)
-			wg.Wait()
+				<-slots
+			}(causticSampleLocations[from:to], &hits[k])
+		}
+		wg.Wait()
+		for _, batch := range hits {
+			for _, hit := range batch {
+				hit.triangle.Photons = append(hit.triangle.Photons, hit.photon)
+			}
 		}
 	}
-	log.Printf("Done building photon map")
+	scene.logf("Done building photon map")
+	return nil
 }
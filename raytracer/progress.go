@@ -0,0 +1,219 @@
+package raytracer
+
+/*
+Progress reporting. Render stages report to the scene's Reporter instead
+of the console, the terminal reporter keeps the familiar progress bars and
+log lines, the JSON reporter writes one event per line for other programs.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb"
+)
+
+// Render stages.
+const (
+	StageScan        = "scan"
+	StageRender      = "render"
+	StageAdaptive    = "adaptive"
+	StageProgressive = "progressive"
+	StageDenoise     = "denoise"
+	StageTiles       = "tiles"
+)
+
+// progressInterval limits how often progress is reported while a stage runs.
+const progressInterval = 100 * time.Millisecond
+
+// Reporter receives render events. Progress counts pixels, or tiles for
+// distributed renders, and may be called from more than one goroutine.
+type Reporter interface {
+	StageStarted(stage string, total int)
+	Progress(stage string, done, total int, eta time.Duration)
+	StageFinished(stage string, elapsed time.Duration)
+	TileCompleted(tile Tile)
+	Message(message string)
+}
+
+// Tile of rendered pixels in frame coordinates. Colors are linear, row by row.
+type Tile struct {
+	Region
+	Pixels []Vector
+}
+
+// reporter of the scene, the terminal reporter if none is set.
+func (s *Scene) reporter() Reporter {
+	if s.Reporter == nil {
+		s.Reporter = NewTerminalReporter()
+	}
+	return s.Reporter
+}
+
+// logf sends a log message to the reporter.
+func (s *Scene) logf(format string, args ...interface{}) {
+	s.reporter().Message(strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+}
+
+// tile of the scene pixels within the region, region is in frame coordinates.
+func (s *Scene) tile(region Region) Tile {
+	t := Tile{Region: region, Pixels: make([]Vector, 0, region.width()*region.height())}
+	for y := region.Top; y < region.Bottom; y++ {
+		for x := region.Left; x < region.Right; x++ {
+			t.Pixels = append(t.Pixels, s.Pixels[x-s.Region.Left][y-s.Region.Top].Color)
+		}
+	}
+	return t
+}
+
+// progress of a running stage.
+type progress struct {
+	sync.Mutex
+	reporter Reporter
+	stage    string
+	total    int
+	done     int
+	start    time.Time
+	last     time.Time
+}
+
+func (s *Scene) startStage(stage string, total int) *progress {
+	r := s.reporter()
+	r.StageStarted(stage, total)
+	now := time.Now()
+	return &progress{reporter: r, stage: stage, total: total, start: now, last: now}
+}
+
+func (p *progress) increment() {
+	p.Lock()
+	defer p.Unlock()
+	p.done++
+	if p.done < p.total && time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	eta := time.Duration(0)
+	if p.done > 0 {
+		eta = time.Since(p.start) / time.Duration(p.done) * time.Duration(p.total-p.done)
+	}
+	p.reporter.Progress(p.stage, p.done, p.total, eta)
+}
+
+func (p *progress) finish() {
+	p.reporter.StageFinished(p.stage, time.Since(p.start))
+}
+
+// TerminalReporter shows progress bars and writes messages to the standard logger.
+type TerminalReporter struct {
+	sync.Mutex
+	bars map[string]*pb.ProgressBar
+}
+
+// NewTerminalReporter for console renders.
+func NewTerminalReporter() *TerminalReporter {
+	return &TerminalReporter{bars: make(map[string]*pb.ProgressBar)}
+}
+
+// StageStarted starts a progress bar for the stage.
+func (t *TerminalReporter) StageStarted(stage string, total int) {
+	t.Lock()
+	defer t.Unlock()
+	t.bars[stage] = pb.StartNew(total)
+}
+
+// Progress moves the stage bar.
+func (t *TerminalReporter) Progress(stage string, done, total int, eta time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	if bar, ok := t.bars[stage]; ok {
+		bar.Set(done)
+	}
+}
+
+// StageFinished completes the stage bar.
+func (t *TerminalReporter) StageFinished(stage string, elapsed time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	if bar, ok := t.bars[stage]; ok {
+		bar.Finish()
+		delete(t.bars, stage)
+	}
+}
+
+// TileCompleted is not shown on the terminal.
+func (t *TerminalReporter) TileCompleted(tile Tile) {}
+
+// Message goes to the standard logger.
+func (t *TerminalReporter) Message(message string) {
+	log.Print(message)
+}
+
+// JSONReporter writes each event as a line of JSON. Completed tiles can be
+// the whole image, their colors are only written when Pixels is set.
+type JSONReporter struct {
+	sync.Mutex
+	Pixels  bool
+	encoder *json.Encoder
+}
+
+// NewJSONReporter writing events to w.
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{encoder: json.NewEncoder(w)}
+}
+
+type jsonEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Stage   string    `json:"stage,omitempty"`
+	Done    int       `json:"done,omitempty"`
+	Total   int       `json:"total,omitempty"`
+	ETA     float64   `json:"eta,omitempty"`
+	Elapsed float64   `json:"elapsed,omitempty"`
+	Region  *Region   `json:"region,omitempty"`
+	Pixels  []Vector  `json:"pixels,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+func (j *JSONReporter) write(event jsonEvent) {
+	j.Lock()
+	defer j.Unlock()
+	event.Time = time.Now()
+	if err := j.encoder.Encode(event); err != nil {
+		log.Printf("Can't write progress event: %s", err.Error())
+	}
+}
+
+// StageStarted event.
+func (j *JSONReporter) StageStarted(stage string, total int) {
+	j.write(jsonEvent{Event: "stage_started", Stage: stage, Total: total})
+}
+
+// Progress event, eta in seconds.
+func (j *JSONReporter) Progress(stage string, done, total int, eta time.Duration) {
+	j.write(jsonEvent{Event: "progress", Stage: stage, Done: done, Total: total, ETA: eta.Seconds()})
+}
+
+// StageFinished event, elapsed in seconds.
+func (j *JSONReporter) StageFinished(stage string, elapsed time.Duration) {
+	j.write(jsonEvent{Event: "stage_finished", Stage: stage, Elapsed: elapsed.Seconds()})
+}
+
+// TileCompleted event, with the linear tile colors if Pixels is set.
+func (j *JSONReporter) TileCompleted(tile Tile) {
+	region := tile.Region
+	event := jsonEvent{Event: "tile_completed", Region: &region}
+	if j.Pixels {
+		event.Pixels = tile.Pixels
+	}
+	j.write(event)
+}
+
+// Message event.
+func (j *JSONReporter) Message(message string) {
+	j.write(jsonEvent{Event: "message", Message: message})
+}
@@ -0,0 +1,88 @@
+package raytracer
+
+/*
+Progressive rendering: after the main pass, pixels keep collecting
+jittered samples pass by pass until the sample or time budget is spent
+or every pixel converged. The current estimate is written out every now
+and then so long renders can be watched.
+*/
+
+import (
+	"context"
+	"time"
+)
+
+// defaultProgressivePasses is used when neither a pass nor a time budget is set.
+const defaultProgressivePasses = 64
+
+type pixelCoord struct {
+	x int
+	y int
+}
+
+func previewDue(config *Config, lastPreview time.Time, pass int) bool {
+	if config.PreviewPasses > 0 && pass%config.PreviewPasses == 0 {
+		return true
+	}
+	interval := time.Duration(config.PreviewInterval * float64(time.Second))
+	return interval > 0 && time.Since(lastPreview) >= interval
+}
+
+// renderProgressive adds passes of samples on top of the main pass.
+func renderProgressive(ctx context.Context, scene *Scene, pixels []pixelCoord, start time.Time, checkpoints *checkpointer, previewFilename string) error {
+	maxPasses := scene.Config.ProgressivePasses
+	budget := time.Duration(scene.Config.ProgressiveTime * float64(time.Second))
+	if maxPasses <= 0 && budget <= 0 {
+		maxPasses = defaultProgressivePasses
+	}
+	outOfTime := func() bool {
+		return budget > 0 && time.Since(start) >= budget
+	}
+
+	lastPreview := time.Now()
+	// Main pass counts as the first one, resumed renders continue after their last pass.
+	for pass := checkpoints.pass + 1; maxPasses <= 0 || pass <= maxPasses; pass++ {
+		if outOfTime() {
+			break
+		}
+		active := make([]pixelCoord, 0, len(pixels))
+		for _, p := range pixels {
+			if !scene.Pixels[p.x][p.y].converged(&scene.Config) {
+				active = append(active, p)
+			}
+		}
+		if len(active) == 0 {
+			scene.logf("All pixels converged after %d passes", pass-1)
+			break
+		}
+		scene.logf("Progressive pass %d, sampling %d pixels", pass, len(active))
+		stage := scene.startStage(StageProgressive, len(active))
+		for _, p := range active {
+			if outOfTime() {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				stage.finish()
+				return err
+			}
+			samplePixel(scene, p.x, p.y)
+			stage.increment()
+		}
+		stage.finish()
+		scene.reporter().TileCompleted(scene.tile(scene.Region))
+		if !outOfTime() {
+			checkpoints.pass = pass
+		}
+		checkpoints.maybeSave(scene)
+
+		if previewFilename != "" && previewDue(&scene.Config, lastPreview, pass) {
+			scene.logf("Writing preview after %d passes", pass)
+			if err := writeOutput(scene, previewFilename); err != nil {
+				return err
+			}
+			lastPreview = time.Now()
+		}
+	}
+	scene.logf("Progressive rendering finished in %f seconds", time.Since(start).Seconds())
+	return nil
+}
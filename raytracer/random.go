@@ -0,0 +1,66 @@
+package raytracer
+
+/*
+Random streams for sampling. Every stream is hashed from the configured
+seed and what it samples, like the pixel and its sample index, instead of
+drawing from a shared generator. Renders with the same seed match bit by
+bit no matter how goroutines are scheduled, tiles are split or renders are
+resumed.
+*/
+
+// Stream keys keep the streams of one pixel sample apart.
+const (
+	streamPixel = iota + 1
+	streamPixelOrder
+	streamLight
+	streamSun
+	streamCaustics
+)
+
+// randomStream is a splitmix64 generator.
+type randomStream struct {
+	state uint64
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// newRandomStream hashed from the keys.
+func newRandomStream(keys ...uint64) randomStream {
+	h := uint64(0x9e3779b97f4a7c15)
+	for _, k := range keys {
+		h = mix64(h ^ mix64(k+0x9e3779b97f4a7c15))
+	}
+	return randomStream{state: h}
+}
+
+func (r *randomStream) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	return mix64(r.state)
+}
+
+// float64 in [0, 1).
+func (r *randomStream) float64() float64 {
+	return float64(r.next()>>11) / (1 << 53)
+}
+
+// intn in [0, n).
+func (r *randomStream) intn(n int) int {
+	return int(r.next() % uint64(n))
+}
+
+// shuffle n elements with swap, like rand.Shuffle.
+func (r *randomStream) shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, r.intn(i+1))
+	}
+}
+
+// random stream of the scene seed for keys.
+func (s *Scene) random(keys ...uint64) randomStream {
+	return newRandomStream(append([]uint64{uint64(s.Config.Seed)}, keys...)...)
+}
@@ -6,11 +6,11 @@ const DIFF = 0.000000001
 // MDIFF Imagine a CPU with no dangling float precision.
 const MDIFF = -0.000000001
 
-// ScreenToWorld conversion.
-func screenToWorld(x, y, width, height int, camera Vector, proj, view Matrix) (rayDir Vector) {
+// ScreenToWorld conversion. Screen coordinates can be fractional for sub-pixel rays.
+func screenToWorld(x, y float64, width, height int, camera Vector, proj, view Matrix) (rayDir Vector) {
 	var xF, yF float64
-	xF = (2.0*float64(x))/float64(width) - 1.0
-	yF = 1.0 - (2.0*float64(y))/float64(height)
+	xF = (2.0*x)/float64(width) - 1.0
+	yF = 1.0 - (2.0*y)/float64(height)
 
 	rayStart := Vector{xF, yF, 1.0, 1.0}
 	invProj := invertMatrix(proj)
@@ -159,39 +159,46 @@ func raycastBoxIntersect(rayStart, rayVector *Vector, boundingBox *BoundingBox)
 	return true
 }
 
-func raycastNodeIntersect(rayStart, rayDir *Vector, node *Node, intersection *Intersection) {
+func raycastNodeIntersect(scene *Scene, rayStart, rayDir *Vector, node *Node, intersection *Intersection) {
 	if !raycastBoxIntersect(rayStart, rayDir, node.BoundingBox) {
 		return
 	}
 
 	if (node.Left != nil && node.Right != nil) && (node.Left.TriangleCount > 0 || node.Right.TriangleCount > 0) {
-		raycastNodeIntersect(rayStart, rayDir, node.Left, intersection)
-		raycastNodeIntersect(rayStart, rayDir, node.Right, intersection)
+		raycastNodeIntersect(scene, rayStart, rayDir, node.Left, intersection)
+		raycastNodeIntersect(scene, rayStart, rayDir, node.Right, intersection)
 		return
 	}
 
 	for i := range node.Triangles {
-		intersectionPoint, normal, hit := raycastTriangleIntersect(
-			rayStart,
-			rayDir,
-			&node.Triangles[i].P1,
-			&node.Triangles[i].P2,
-			&node.Triangles[i].P3,
-		)
+		triangle := &node.Triangles[i]
+		p1, p2, p3 := &triangle.P1, &triangle.P2, &triangle.P3
+		if triangle.motion != nil {
+			m1, m2, m3 := triangle.positionsAt(intersection.Time)
+			p1, p2, p3 = &m1, &m2, &m3
+		}
+		intersectionPoint, normal, hit := raycastTriangleIntersect(rayStart, rayDir, p1, p2, p3)
 		if hit {
+			if triangle.motion != nil {
+				// Hits keep the triangle where it was at ray time,
+				// photons stored on it are lost.
+				moved := triangle.at(intersection.Time)
+				triangle = &moved
+			}
 			intersection.Hits++
 			dist := pvectorDistance(intersectionPoint, rayStart)
-			if node.Triangles[i].Material.Texture != "" {
+			if triangle.Material.Texture != "" {
 				temp := Intersection{
 					Hit:                true,
 					IntersectionNormal: *normal,
 					Intersection:       *intersectionPoint,
-					Triangle:           &node.Triangles[i],
+					Triangle:           triangle,
 					RayDir:             *rayDir,
 					RayStart:           *rayStart,
 					Dist:               dist,
+					Time:               intersection.Time,
 				}
-				if temp.getColor()[3] < 1 {
+				if temp.getColor(scene)[3] < 1 {
 					continue
 				}
 			}
@@ -199,25 +206,27 @@ func raycastNodeIntersect(rayStart, rayDir *Vector, node *Node, intersection *In
 				intersection.Hit = true
 				intersection.IntersectionNormal = *normal
 				intersection.Intersection = *intersectionPoint
-				intersection.Triangle = &node.Triangles[i]
+				intersection.Triangle = triangle
 				intersection.RayStart = *rayStart
 				intersection.RayDir = *rayDir
 				intersection.Dist = dist
-				intersection.getNormal()
+				intersection.getNormal(scene)
 			}
 		}
 	}
 }
 
-func raycastObjectIntersect(object *Object, rayStart, rayDir *Vector) (intersection Intersection) {
+// raycastObjectIntersect finds the closest hit, time is the shutter position of the ray.
+func raycastObjectIntersect(scene *Scene, object *Object, rayStart, rayDir *Vector, time float64) (intersection Intersection) {
 	intersection.Dist = -1
-	raycastNodeIntersect(rayStart, rayDir, &object.Root, &intersection)
+	intersection.Time = time
+	raycastNodeIntersect(scene, rayStart, rayDir, &object.Root, &intersection)
 	return
 }
 
-func raycastSceneIntersect(scene *Scene, position, ray Vector) Intersection {
-	position = addVector(position, scaleVector(ray, GlobalConfig.RayCorrection))
-	intersect := raycastObjectIntersect(scene.MasterObject, &position, &ray)
+func raycastSceneIntersect(scene *Scene, position, ray Vector, time float64) Intersection {
+	position = addVector(position, scaleVector(ray, scene.Config.RayCorrection))
+	intersect := raycastObjectIntersect(scene, scene.MasterObject, &position, &ray, time)
 	intersect.RayDir = ray
 	if !intersect.Hit {
 		return intersect
@@ -0,0 +1,141 @@
+package raytracer
+
+/*
+Region rendering. Only a rectangle of the frame is raycast and rendered,
+scene pixels are stored for the region alone. Output is either the full
+frame with the region filled in (border) or just the region (crop).
+Region outputs can be stitched back into a full frame with Merge.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Region of the frame in pixels, Right and Bottom are exclusive.
+type Region struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+}
+
+// ParseRegion reads a region in left,top,right,bottom form.
+func ParseRegion(value string) (Region, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return Region{}, fmt.Errorf("region %s is not in left,top,right,bottom form", value)
+	}
+	bounds := make([]int, 4)
+	for i := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+		if err != nil {
+			return Region{}, fmt.Errorf("region %s: %s", value, err.Error())
+		}
+		bounds[i] = v
+	}
+	return Region{Left: bounds[0], Top: bounds[1], Right: bounds[2], Bottom: bounds[3]}, nil
+}
+
+func (r Region) String() string {
+	return fmt.Sprintf("%d,%d,%d,%d", r.Left, r.Top, r.Right, r.Bottom)
+}
+
+func (r Region) width() int {
+	return r.Right - r.Left
+}
+
+func (r Region) height() int {
+	return r.Bottom - r.Top
+}
+
+// fit checks the region against the frame, an empty region is the whole frame.
+func (r Region) fit(width, height int) (Region, error) {
+	if r == (Region{}) {
+		return Region{Left: 0, Top: 0, Right: width, Bottom: height}, nil
+	}
+	if r.Left < 0 || r.Top < 0 || r.Right > width || r.Bottom > height || r.width() <= 0 || r.height() <= 0 {
+		return r, fmt.Errorf("region %s is outside of the %dx%d frame", r, width, height)
+	}
+	return r, nil
+}
+
+// regionFilename adds the region to filename when there is more than one region to render.
+func regionFilename(filename string, region Region, count int) string {
+	if count < 2 || filename == "" {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s_%d_%d_%d_%d%s", strings.TrimSuffix(filename, ext), region.Left, region.Top, region.Right, region.Bottom, ext)
+}
+
+// regionInfo is written next to region outputs that can't store their offset.
+type regionInfo struct {
+	Region
+	FrameWidth  int  `json:"frame_width"`
+	FrameHeight int  `json:"frame_height"`
+	Crop        bool `json:"crop"`
+}
+
+func regionInfoFilename(filename string) string {
+	return filename + ".region.json"
+}
+
+func writeRegionInfo(scene *Scene, filename string) error {
+	data, err := json.MarshalIndent(regionInfo{
+		Region:      scene.Region,
+		FrameWidth:  scene.frameWidth,
+		FrameHeight: scene.frameHeight,
+		Crop:        scene.Crop,
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(regionInfoFilename(filename), data, 0644)
+}
+
+func readRegionInfo(filename string) (*regionInfo, error) {
+	data, err := ioutil.ReadFile(regionInfoFilename(filename))
+	if err != nil {
+		return nil, fmt.Errorf("no region information for %s: %s", filename, err.Error())
+	}
+	info := regionInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// fullFrame tells if the scene pixels cover the whole frame.
+func (s *Scene) fullFrame() bool {
+	return s.Region == Region{Left: 0, Top: 0, Right: s.frameWidth, Bottom: s.frameHeight}
+}
+
+// setRegion allocates and scans the pixels of the region to render.
+func (s *Scene) setRegion(ctx context.Context, region Region) error {
+	s.Region = region
+	s.Width = region.width()
+	s.Height = region.height()
+	return s.scanPixels(ctx)
+}
+
+// framedScene returns a copy of the scene with full frame pixels,
+// region pixels are placed at their offset.
+func (s *Scene) framedScene() *Scene {
+	framed := *s
+	framed.Region = Region{Left: 0, Top: 0, Right: s.frameWidth, Bottom: s.frameHeight}
+	framed.Width = s.frameWidth
+	framed.Height = s.frameHeight
+	framed.allocatePixels()
+	for i := 0; i < s.Width; i++ {
+		for j := 0; j < s.Height; j++ {
+			framed.Pixels[i+s.Region.Left][j+s.Region.Top] = s.Pixels[i][j]
+		}
+	}
+	return &framed
+}
@@ -0,0 +1,139 @@
+package raytracer
+
+/*
+Renderer is the library entry point. Configuration, textures and caches
+belong to the renderer's scene instead of the package, so independent
+renders can run side by side in one process. Images are rendered in
+memory, nothing is written to disk.
+*/
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Renderer renders a scene with its own configuration.
+type Renderer struct {
+	Config Config
+	// Reporter receives progress of the scenes, the terminal if not set.
+	Reporter Reporter
+	scene    *Scene
+	prepared bool
+}
+
+// Image is a rendered frame. Pixels hold linear colors row by row,
+// RGBA maps them through the display transform of the render.
+type Image struct {
+	Width   int
+	Height  int
+	Pixels  []Vector
+	display *displayTransform
+}
+
+// NewRenderer with given configuration, use DEFAULT or LoadConfig for one.
+func NewRenderer(config Config) *Renderer {
+	return &Renderer{Config: config}
+}
+
+// LoadScene reads the scene file. The returned scene can be adjusted, to
+// pick a camera for example, before it is rendered.
+func (r *Renderer) LoadScene(ctx context.Context, filename string) (*Scene, error) {
+	scene := &Scene{Config: r.Config, Reporter: r.Reporter}
+	if err := scene.load(ctx, filename, ""); err != nil {
+		return nil, err
+	}
+	r.scene = scene
+	r.prepared = false
+	return scene, nil
+}
+
+// SetScene to render a scene built in code, see NewScene.
+func (r *Renderer) SetScene(scene *Scene) {
+	if scene.Reporter == nil {
+		scene.Reporter = r.Reporter
+	}
+	r.scene = scene
+	r.prepared = false
+}
+
+// Render the selected camera of the loaded scene at the configured size.
+// Animated scenes are rendered at their first frame.
+func (r *Renderer) Render(ctx context.Context) (*Image, error) {
+	scene := r.scene
+	if scene == nil {
+		return nil, fmt.Errorf("no scene loaded")
+	}
+	cameras, err := scene.selectCameras()
+	if err != nil {
+		return nil, err
+	}
+	if !r.prepared {
+		if len(scene.Frames) > 0 {
+			scene.frame = float64(scene.Frames[0])
+		}
+		if err := scene.prepare(ctx); err != nil {
+			return nil, err
+		}
+		if len(scene.Frames) > 0 {
+			if err := scene.setFrame(ctx, scene.Frames[0]); err != nil {
+				return nil, err
+			}
+		}
+		r.prepared = true
+	}
+	width, height := scene.cameraFrameSize(cameras[0], scene.Config.Width, scene.Config.Height)
+	scene.useCamera(cameras[0], width, height)
+	if err := scene.setRegion(ctx, Region{Left: 0, Top: 0, Right: width, Bottom: height}); err != nil {
+		return nil, err
+	}
+
+	scene.logf("Rendering %d x %d in memory", width, height)
+	// Checkpoints without an interval are never saved.
+	if err := renderPixels(ctx, scene, 100, "", &checkpointer{}); err != nil {
+		return nil, err
+	}
+	if err := scene.meterExposure(); err != nil {
+		return nil, err
+	}
+	display, err := newDisplayTransform(scene)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		Width:   width,
+		Height:  height,
+		Pixels:  make([]Vector, width*height),
+		display: display,
+	}
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			img.Pixels[j*width+i] = scene.Pixels[i][j].Color
+		}
+	}
+	return img, nil
+}
+
+// At returns the linear color of the pixel.
+func (img *Image) At(x, y int) Vector {
+	return img.Pixels[y*img.Width+x]
+}
+
+// RGBA maps the image into 8-bit display colors.
+func (img *Image) RGBA() *image.RGBA {
+	result := image.NewRGBA(image.Rect(0, 0, img.Width, img.Height))
+	for i := 0; i < img.Width; i++ {
+		for j := 0; j < img.Height; j++ {
+			pcolor := img.display.apply(img.At(i, j))
+			result.Set(i, j, color.RGBA{
+				R: uint8(math.Floor(pcolor[0] * 255)),
+				G: uint8(math.Floor(pcolor[1] * 255)),
+				B: uint8(math.Floor(pcolor[2] * 255)),
+				A: uint8(math.Floor(pcolor[3] * 255)),
+			})
+		}
+	}
+	return result
+}
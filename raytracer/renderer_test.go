@@ -0,0 +1,96 @@
+package raytracer
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+// testScene is a small scene with diffuse, glossy, rough and glass
+// surfaces, lit by a point light and a light material.
+func testScene(t *testing.T, config Config) *Scene {
+	scene := NewScene(config)
+	objects := []struct {
+		name     string
+		build    func(Material) (*Object, error)
+		material Material
+		offset   Vector
+	}{
+		{"floor", func(m Material) (*Object, error) { return NewPlane(10, 10, m) },
+			Material{Color: Vector{0.8, 0.8, 0.8, 1}}, Vector{}},
+		{"mirror", func(m Material) (*Object, error) { return NewBox(Vector{1, 1, 1, 0}, m) },
+			Material{Color: Vector{0.9, 0.3, 0.2, 1}, Glossiness: 0.6, Roughness: 0.3}, Vector{-1, 0, 0.5, 0}},
+		{"glass", func(m Material) (*Object, error) { return NewSphere(0.6, 12, 8, m) },
+			Material{Color: Vector{1, 1, 1, 1}, Transmission: 0.8, IndexOfRefraction: 1.5}, Vector{1, 0, 0.6, 0}},
+		{"lamp", func(m Material) (*Object, error) { return NewPlane(1, 1, m) },
+			Material{Color: Vector{1, 1, 1, 1}, Light: true, LightStrength: 4}, Vector{0, 0, 3, 0}},
+	}
+	for _, o := range objects {
+		object, err := o.build(o.material)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := scene.AddObject(o.name, object.Translate(o.offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := scene.AddLight(NewPointLight(Vector{2, -2, 4}, Vector{1, 1, 1, 1}, 30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := scene.AddCamera(NewCamera("camera", Vector{0, -6, 2.5}, Vector{0, 0, 0.5}, 50)); err != nil {
+		t.Fatal(err)
+	}
+	return scene
+}
+
+func renderTestScene(t *testing.T, config Config) *Image {
+	renderer := NewRenderer(config)
+	renderer.Reporter = NewJSONReporter(ioutil.Discard)
+	renderer.SetScene(testScene(t, config))
+	img, err := renderer.Render(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestRenderSeedReproducible(t *testing.T) {
+	config := DEFAULT
+	config.Width = 16
+	config.Height = 12
+	config.AdaptiveMaxSamples = 8
+	config.SamplerLimit = 4
+	config.LightSampleCount = 4
+	config.RenderCaustics = true
+	config.CausticsSamplerLimit = 20
+	config.Seed = 7
+
+	for _, sampler := range []string{SamplerRandom, SamplerStratified, SamplerHalton, SamplerSobol} {
+		config.Sampler = sampler
+		first := renderTestScene(t, config)
+		second := renderTestScene(t, config)
+		lit := false
+		for i := range first.Pixels {
+			lit = lit || first.Pixels[i][0] > 0
+			if first.Pixels[i] != second.Pixels[i] {
+				t.Fatalf("%s: pixel %d, %d is %v, then %v with the same seed", sampler,
+					i%first.Width, i/first.Width, first.Pixels[i], second.Pixels[i])
+			}
+		}
+		if !lit {
+			t.Fatalf("%s: scene rendered black", sampler)
+		}
+	}
+
+	config.Sampler = SamplerSobol
+	first := renderTestScene(t, config)
+	config.Seed = 8
+	other := renderTestScene(t, config)
+	changed := false
+	for i := range first.Pixels {
+		changed = changed || first.Pixels[i] != other.Pixels[i]
+	}
+	if !changed {
+		t.Error("another seed renders the same pixels")
+	}
+}
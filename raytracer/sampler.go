@@ -0,0 +1,250 @@
+package raytracer
+
+/*
+Samplers place the sample points of the render dimensions: pixel jitter,
+lens, shutter time, light positions, ambient occlusion and glossy
+directions. Every dimension of a pixel is a 2D sequence of points, the
+pixel hash randomizes it so neighbouring pixels don't share their
+patterns. Low discrepancy sequences fill the dimensions more evenly than
+independent random points and converge faster with the same samples.
+*/
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Samplers to pick with the sampler config option.
+const (
+	SamplerRandom     = "random"
+	SamplerStratified = "stratified"
+	SamplerHalton     = "halton"
+	SamplerSobol      = "sobol"
+)
+
+// Camera dimensions of a pixel sample, the dimensions of the path follow them.
+const (
+	dimensionPixel = iota
+	dimensionLens
+	dimensionTime
+	dimensionPath
+)
+
+// Branches of spawned rays, so reflected and refracted rays sample apart.
+const (
+	branchReflection = iota
+	branchRefraction
+)
+
+// Sampler returns the points of sample dimensions.
+type Sampler interface {
+	// Point is the point at index of the dimension for the pixel hash, in [0, 1).
+	Point(pixel uint64, dimension, index int) (float64, float64)
+}
+
+// newSampler for the configuration. Stratified samples are laid out for
+// the sample budget of a pixel, time budgets without a pass budget are
+// laid out in blocks of the default passes.
+func newSampler(config *Config) (Sampler, error) {
+	switch config.Sampler {
+	case SamplerRandom:
+		return randomSampler{}, nil
+	case SamplerStratified:
+		strata := config.AdaptiveMaxSamples
+		if config.Progressive {
+			strata = config.ProgressivePasses
+			if strata <= 0 {
+				strata = defaultProgressivePasses
+			}
+		}
+		return newStratifiedSampler(strata), nil
+	case SamplerHalton:
+		return haltonSampler{}, nil
+	case SamplerSobol, "":
+		return sobolSampler{}, nil
+	}
+	return nil, fmt.Errorf("unknown sampler %s", config.Sampler)
+}
+
+// randomSampler draws independent points.
+type randomSampler struct{}
+
+func (randomSampler) Point(pixel uint64, dimension, index int) (float64, float64) {
+	r := newRandomStream(pixel, uint64(dimension), uint64(index))
+	return r.float64(), r.float64()
+}
+
+// stratifiedSampler jitters points in the cells of a grid. Each block of
+// strata points covers every cell once, in a shuffled order.
+type stratifiedSampler struct {
+	strata  int
+	columns int
+	rows    int
+}
+
+func newStratifiedSampler(strata int) stratifiedSampler {
+	if strata < 1 {
+		strata = 1
+	}
+	// The grid has to tile the cells exactly, cells left out would bias the points.
+	columns := int(math.Sqrt(float64(strata)))
+	for strata%columns != 0 {
+		columns--
+	}
+	rows := strata / columns
+	return stratifiedSampler{strata: strata, columns: columns, rows: rows}
+}
+
+func (s stratifiedSampler) Point(pixel uint64, dimension, index int) (float64, float64) {
+	block := newRandomStream(pixel, uint64(dimension), uint64(index/s.strata))
+	// Affine permutation of the cells, the multiplier has to be coprime to strata.
+	multiplier := 1 + block.intn(s.strata)
+	for gcd(multiplier, s.strata) != 1 {
+		multiplier++
+	}
+	cell := (index%s.strata*multiplier + block.intn(s.strata)) % s.strata
+	jitter := newRandomStream(pixel, uint64(dimension), uint64(index), 1)
+	x := (float64(cell%s.columns) + jitter.float64()) / float64(s.columns)
+	y := (float64(cell/s.columns) + jitter.float64()) / float64(s.rows)
+	return x, y
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// haltonPrimes are the bases of Halton dimensions, two per dimension.
+var haltonPrimes = []int{
+	2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53,
+	59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131,
+}
+
+// haltonSampler uses radical inverses in prime bases. Every digit is
+// permuted with a seed of the pixel and dimension (random digit
+// scrambling), which breaks the correlation of the large bases and
+// randomizes the points without losing their stratification. Dimensions
+// past the prime table repeat the bases with other permutations.
+type haltonSampler struct{}
+
+func (haltonSampler) Point(pixel uint64, dimension, index int) (float64, float64) {
+	pair := dimension % (len(haltonPrimes) / 2)
+	r := newRandomStream(pixel, uint64(dimension))
+	x := scrambledRadicalInverse(haltonPrimes[2*pair], index, r.next())
+	y := scrambledRadicalInverse(haltonPrimes[2*pair+1], index, r.next())
+	return x, y
+}
+
+// scrambledRadicalInverse mirrors the digits of index in base around the
+// radix point, permuting each digit with a permutation of seed and the digit
+// position. Trailing zero digits are permuted too, so the result is uniform.
+func scrambledRadicalInverse(base, index int, seed uint64) float64 {
+	inverse := 1 / float64(base)
+	factor := inverse
+	result := 0.0
+	for digit := uint64(0); factor > 1e-16; digit++ {
+		result += float64(permuteDigit(index%base, base, seed, digit)) * factor
+		index /= base
+		factor *= inverse
+	}
+	return math.Min(result, 1-0x1p-53)
+}
+
+// permuteDigit applies the affine permutation of seed and digit position,
+// bases are prime so every multiplier is coprime to them.
+func permuteDigit(d, base int, seed, digit uint64) int {
+	r := newRandomStream(seed, digit)
+	multiplier := 1 + r.intn(base-1)
+	return (d*multiplier + r.intn(base)) % base
+}
+
+// sobolSampler uses the first two Sobol dimensions with hash based Owen
+// scrambling. Every dimension shuffles the indices and scrambles the
+// points with its own seeds, so dimensions don't correlate.
+type sobolSampler struct{}
+
+func (sobolSampler) Point(pixel uint64, dimension, index int) (float64, float64) {
+	r := newRandomStream(pixel, uint64(dimension))
+	seed := r.next()
+	shuffled := owenScramble(uint32(index), uint32(seed))
+	x := owenScramble(bits.Reverse32(shuffled), uint32(seed>>32))
+	y := owenScramble(sobolSecond(shuffled), uint32(r.next()))
+	return float64(x) / (1 << 32), float64(y) / (1 << 32)
+}
+
+// sobolSecond is the second Sobol dimension, the first is the bit reversed index.
+func sobolSecond(index uint32) uint32 {
+	v := uint32(1) << 31
+	result := uint32(0)
+	for ; index != 0; index >>= 1 {
+		if index&1 != 0 {
+			result ^= v
+		}
+		v ^= v >> 1
+	}
+	return result
+}
+
+// owenScramble is the nested uniform scramble of Laine and Karras' hash.
+func owenScramble(x, seed uint32) uint32 {
+	x = bits.Reverse32(x)
+	x += seed
+	x ^= x * 0x6c50b47c
+	x ^= x * 0xb82f1e52
+	x ^= x * 0xc7afe638
+	x ^= x * 0x8d22f6e6
+	return bits.Reverse32(x)
+}
+
+// pathSample is where a ray is in the sample dimensions: the pixel and
+// sample index it belongs to and the next dimension to draw.
+type pathSample struct {
+	pixel     uint64
+	index     int
+	dimension int
+}
+
+// pixelSample of the scene pixel, x and y are scene pixel coordinates. The
+// frame, camera and frame coordinates take part so regions and tiles of
+// the frame sample like the full frame.
+func (s *Scene) pixelSample(x, y, index int) pathSample {
+	r := s.random(streamPixel, math.Float64bits(s.frame), uint64(s.cameraIndex),
+		uint64(x+s.Region.Left), uint64(y+s.Region.Top))
+	return pathSample{pixel: r.next(), index: index, dimension: dimensionPath}
+}
+
+// lensPoint of the pixel sample, only drawn for cameras with a lens.
+func (s *Scene) lensPoint(p pathSample) [2]float64 {
+	if s.camera().lensRadius <= 0 {
+		return [2]float64{}
+	}
+	u, v := s.cameraPoint(p, dimensionLens)
+	return [2]float64{u, v}
+}
+
+// cameraPoint of the pixel sample.
+func (s *Scene) cameraPoint(p pathSample, dimension int) (float64, float64) {
+	return s.sampler.Point(p.pixel, dimension, p.index)
+}
+
+// pathPoints draws count points of the next dimension for the sample, the
+// points of one sample are consecutive in the sequence.
+func (s *Scene) pathPoints(p *pathSample, count int) [][2]float64 {
+	points := make([][2]float64, count)
+	for k := range points {
+		points[k][0], points[k][1] = s.sampler.Point(p.pixel, p.dimension, p.index*count+k)
+	}
+	p.dimension++
+	return points
+}
+
+// child is the sample of ray k spawned for branch. It keeps the sample
+// index, so sample sequences don't grow with depth, and the pixel hash
+// is mixed with the branch and ray to scramble its dimensions apart.
+func (p *pathSample) child(branch, k int) pathSample {
+	r := newRandomStream(p.pixel, uint64(branch), uint64(k))
+	return pathSample{pixel: r.next(), index: p.index, dimension: p.dimension}
+}
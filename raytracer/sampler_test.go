@@ -0,0 +1,142 @@
+package raytracer
+
+import "testing"
+
+func testSamplers() map[string]Sampler {
+	return map[string]Sampler{
+		SamplerRandom:            randomSampler{},
+		SamplerStratified + "12": newStratifiedSampler(12),
+		SamplerStratified + "16": newStratifiedSampler(16),
+		SamplerHalton:            haltonSampler{},
+		SamplerSobol:             sobolSampler{},
+	}
+}
+
+func TestSamplerRange(t *testing.T) {
+	indices := []int{0, 1, 2, 3, 255, 256, 1 << 20, 1<<31 - 1}
+	for i := 0; i < 1024; i++ {
+		indices = append(indices, i)
+	}
+	for name, sampler := range testSamplers() {
+		for _, pixel := range []uint64{0, 1, 0xdeadbeef, ^uint64(0)} {
+			for dimension := 0; dimension < 40; dimension++ {
+				for _, index := range indices {
+					x, y := sampler.Point(pixel, dimension, index)
+					if x < 0 || x >= 1 || y < 0 || y >= 1 {
+						t.Fatalf("%s: point %d of dimension %d is (%g, %g), outside of [0, 1)", name, index, dimension, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSamplerDeterministic(t *testing.T) {
+	for name, sampler := range testSamplers() {
+		same := 0
+		for dimension := 0; dimension < 8; dimension++ {
+			for index := 0; index < 64; index++ {
+				x1, y1 := sampler.Point(42, dimension, index)
+				x2, y2 := sampler.Point(42, dimension, index)
+				if x1 != x2 || y1 != y2 {
+					t.Fatalf("%s: point %d of dimension %d changed between calls", name, index, dimension)
+				}
+				x3, y3 := sampler.Point(43, dimension, index)
+				if x1 == x3 && y1 == y3 {
+					same++
+				}
+			}
+		}
+		if same > 0 {
+			t.Errorf("%s: %d points are the same for other pixels", name, same)
+		}
+	}
+}
+
+// stratified tells if every one of the cells of 0..1 holds one of the values.
+func stratified(values []float64, cells int) bool {
+	seen := make([]bool, cells)
+	for _, v := range values {
+		cell := int(v * float64(cells))
+		if seen[cell] {
+			return false
+		}
+		seen[cell] = true
+	}
+	return len(values) == cells
+}
+
+func TestSobolStratification(t *testing.T) {
+	sampler := sobolSampler{}
+	for _, pixel := range []uint64{0, 7, 0x9e3779b97f4a7c15} {
+		for dimension := 0; dimension < 16; dimension++ {
+			for k := uint(0); k <= 10; k++ {
+				n := 1 << k
+				xs := make([]float64, n)
+				ys := make([]float64, n)
+				for i := 0; i < n; i++ {
+					xs[i], ys[i] = sampler.Point(pixel, dimension, i)
+				}
+				if !stratified(xs, n) || !stratified(ys, n) {
+					t.Fatalf("first %d points of dimension %d aren't stratified", n, dimension)
+				}
+				// Elementary intervals of 2^a by 2^(k-a) cells hold one point each.
+				for a := uint(0); a <= k; a++ {
+					cells := make(map[[2]int]bool)
+					for i := 0; i < n; i++ {
+						cell := [2]int{int(xs[i] * float64(int(1)<<a)), int(ys[i] * float64(int(1)<<(k-a)))}
+						if cells[cell] {
+							t.Fatalf("first %d points of dimension %d share a %dx%d cell", n, dimension, 1<<a, 1<<(k-a))
+						}
+						cells[cell] = true
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestHaltonStratification(t *testing.T) {
+	sampler := haltonSampler{}
+	for dimension := 0; dimension < 16; dimension++ {
+		pair := dimension % (len(haltonPrimes) / 2)
+		xBase, yBase := haltonPrimes[2*pair], haltonPrimes[2*pair+1]
+		xn, yn := xBase, yBase
+		for xn*xBase <= 1024 {
+			xn *= xBase
+		}
+		for yn*yBase <= 1024 {
+			yn *= yBase
+		}
+		xs := make([]float64, xn)
+		for i := range xs {
+			xs[i], _ = sampler.Point(3, dimension, i)
+		}
+		ys := make([]float64, yn)
+		for i := range ys {
+			_, ys[i] = sampler.Point(3, dimension, i)
+		}
+		if !stratified(xs, xn) || !stratified(ys, yn) {
+			t.Errorf("first points of dimension %d aren't stratified in bases %d and %d", dimension, xBase, yBase)
+		}
+	}
+}
+
+func TestStratifiedCells(t *testing.T) {
+	for _, strata := range []int{1, 7, 8, 12, 16} {
+		sampler := newStratifiedSampler(strata)
+		if sampler.columns*sampler.rows != strata {
+			t.Fatalf("%d strata laid out as %dx%d", strata, sampler.columns, sampler.rows)
+		}
+		for block := 0; block < 4; block++ {
+			cells := make(map[[2]int]bool)
+			for i := block * strata; i < (block+1)*strata; i++ {
+				x, y := sampler.Point(11, 2, i)
+				cells[[2]int{int(x * float64(sampler.columns)), int(y * float64(sampler.rows))}] = true
+			}
+			if len(cells) != strata {
+				t.Errorf("block %d of %d strata covers %d cells", block, strata, len(cells))
+			}
+		}
+	}
+}
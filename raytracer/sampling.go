@@ -1,66 +1,131 @@
 package raytracer
 
 import (
-	"math/rand"
+	"math"
 	"sort"
 )
 
-var sampleCache [][]Vector
+// Hemisphere samplings to pick with the hemisphere_sampling config option.
+const (
+	HemisphereCosine  = "cosine"
+	HemisphereUniform = "uniform"
+)
 
-func createCache() {
-	sampleCache = make([][]Vector, 10)
-	// Create 10 different cache variations
-	for index := 0; index < 10; index++ {
-		sampleCache[index] = make([]Vector, 100000)
-		for i := 0; i < 100000; i++ {
-			x := rand.Float64() - 0.5
-			y := rand.Float64() - 0.5
-			z := rand.Float64() - 0.5
-			v := normalizeVector(Vector{x, y, z, 0})
-			sampleCache[index][i] = v
+// hemisphereSamples picks count directions around the normal for ambient
+// occlusion and ambient colors, weighted so the mean of weight times what a
+// direction sees converges to the cosine weighted average over the
+// hemisphere. Cosine samples weigh 1, uniform samples 2 cos θ.
+func (s *Scene) hemisphereSamples(p *pathSample, normal Vector, count int) ([]Vector, []float64) {
+	dirs := make([]Vector, count)
+	weights := make([]float64, count)
+	for k, point := range s.pathPoints(p, count) {
+		var x, y, z float64
+		if s.Config.HemisphereSampling == HemisphereUniform {
+			x, y, z = uniformHemisphere(point[0], point[1])
+			weights[k] = 2 * z
+		} else {
+			x, y, z = cosineHemisphere(point[0], point[1])
+			weights[k] = 1
 		}
+		dirs[k] = tangentToWorld(normal, x, y, z)
 	}
+	return dirs, weights
 }
 
-func createSamples(normal Vector, limit int, shifting float64) []Vector {
-	if sampleCache == nil {
-		createCache()
-	}
-	index := rand.Int() % 10
+// uniformHemisphere maps the point to a direction around z with density 1 / 2π.
+func uniformHemisphere(u, v float64) (float64, float64, float64) {
+	z := 1 - u
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * v
+	return r * math.Cos(phi), r * math.Sin(phi), z
+}
 
-	result := make([]Vector, 0, limit)
-	result = append(result, normal)
+// cosineHemisphere maps the point to a direction around z with density
+// cos θ / π, lifting the concentric disk mapping up to the hemisphere.
+func cosineHemisphere(u, v float64) (float64, float64, float64) {
+	x, y := sampleLens(u, v, 0, 0)
+	return x, y, math.Sqrt(math.Max(0, 1-x*x-y*y))
+}
 
-	for i := range sampleCache[index] {
-		if sameSideTest(sampleCache[index][i], normal, shifting) {
-			result = append(result, sampleCache[index][i])
-			if len(result) == limit {
-				break
-			}
+// glossySamples reflects the ray off count microfacet normals of the GGX
+// distribution of roughness. Normals are drawn from the ones visible to the
+// ray (Heitz 2018), which leaves the Smith masking of the reflected ray as
+// the weight. Reflections below the surface weigh 0.
+func (s *Scene) glossySamples(p *pathSample, normal, rayDir Vector, roughness float64, count int) ([]Vector, []float64) {
+	if dot(rayDir, normal) > 0 {
+		normal = scaleVector(normal, -1)
+	}
+	alpha := math.Max(roughness*roughness, 1e-4)
+	tangent, bitangent := tangentFrame(normal)
+	// Grazing rays are kept just above the surface, masking is infinite at the horizon.
+	view := Vector{-dot(rayDir, tangent), -dot(rayDir, bitangent), math.Max(-dot(rayDir, normal), 1e-6), 0}
+	dirs := make([]Vector, count)
+	weights := make([]float64, count)
+	for k, point := range s.pathPoints(p, count) {
+		x, y, z := ggxVisibleNormal(view, alpha, point[0], point[1])
+		dirs[k] = reflectVector(rayDir, tangentToWorld(normal, x, y, z))
+		if cosine := dot(dirs[k], normal); cosine > 0 {
+			lambdaView := smithLambda(view[2], alpha)
+			weights[k] = (1 + lambdaView) / (1 + lambdaView + smithLambda(cosine, alpha))
 		}
 	}
-	return result
+	return dirs, weights
 }
 
-func sampleSphere(radius float64, limit int) []Vector {
+// ggxVisibleNormal maps the point to a microfacet normal around z, drawn
+// from the GGX normals of alpha visible from view.
+func ggxVisibleNormal(view Vector, alpha, u, v float64) (float64, float64, float64) {
+	// Stretch the view to the hemisphere configuration.
+	vh := normalizeVector(Vector{alpha * view[0], alpha * view[1], math.Max(view[2], 0), 0})
+	t1 := Vector{1, 0, 0, 0}
+	if length := math.Hypot(vh[0], vh[1]); length > 0 {
+		t1 = Vector{-vh[1] / length, vh[0] / length, 0, 0}
+	}
+	t2 := crossProduct(vh, t1)
+	// Pick a point on the projected disk, warped to the visible half.
+	r := math.Sqrt(u)
+	phi := 2 * math.Pi * v
+	p1 := r * math.Cos(phi)
+	p2 := r * math.Sin(phi)
+	blend := 0.5 * (1 + vh[2])
+	p2 = (1-blend)*math.Sqrt(math.Max(0, 1-p1*p1)) + blend*p2
+	nh := combine(combine(t1, t2, p1, p2), vh, 1, math.Sqrt(math.Max(0, 1-p1*p1-p2*p2)))
+	// Unstretch back to the ellipsoid.
+	n := normalizeVector(Vector{alpha * nh[0], alpha * nh[1], math.Max(nh[2], 0), 0})
+	return n[0], n[1], n[2]
+}
+
+// smithLambda is the Smith masking term of GGX for a direction with cosine to the normal.
+func smithLambda(cosine, alpha float64) float64 {
+	if cosine >= 1 {
+		return 0
+	}
+	tan2 := (1 - cosine*cosine) / (cosine * cosine)
+	return (math.Sqrt(1+alpha*alpha*tan2) - 1) / 2
+}
+
+// sampleSphere offsets within a cube of radius, seed picks the points of the sampler.
+func sampleSphere(sampler Sampler, seed uint64, radius float64, limit int) []Vector {
 	result := make([]Vector, limit)
 	for i := 0; i < limit; i++ {
+		x, y := sampler.Point(seed, 0, i)
+		z, _ := sampler.Point(seed, 1, i)
 		result[i] = Vector{
-			(rand.Float64() - 0.5) * radius,
-			(rand.Float64() - 0.5) * radius,
-			(rand.Float64() - 0.5) * radius,
+			(x - 0.5) * radius,
+			(y - 0.5) * radius,
+			(z - 0.5) * radius,
 			1,
 		}
 	}
 	return result
 }
 
-func sampleTriangle(triangle Triangle, count int) []Vector {
+// sampleTriangle picks points on the triangle, seed picks the points of the sampler.
+func sampleTriangle(sampler Sampler, seed uint64, triangle Triangle, count int) []Vector {
 	result := make([]Vector, count)
 	for i := 0; i < count; i++ {
-		vl := []float64{
-			rand.Float64(), rand.Float64(),
-		}
+		u, v := sampler.Point(seed, 0, i)
+		vl := []float64{u, v}
 		sort.Float64s(vl)
 		s := vl[0]
 		t := vl[1]
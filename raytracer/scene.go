@@ -1,49 +1,83 @@
 package raytracer
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"image"
 	_ "image/jpeg" // fuck you go-linter
 	_ "image/png"  // fuck you go-linter
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
-
-	"github.com/cheggaaa/pb"
 )
 
-// EnvironmentMap cache.
-var EnvironmentMap [][]Vector
-var hasEnvironmentMap bool
-
 // Light structure.
 type Light struct {
-	Position      Vector  `json:"position"`
-	Color         Vector  `json:"color"`
-	Active        bool    `json:"active"`
-	LightStrength float64 `json:"light_strength"`
-	Directional   bool    `json:"directional_light"`
-	Direction     Vector  `json:"direction"`
+	Position      Vector          `json:"position"`
+	Color         Vector          `json:"color"`
+	Active        bool            `json:"active"`
+	LightStrength float64         `json:"light_strength"`
+	Directional   bool            `json:"directional_light"`
+	Direction     Vector          `json:"direction"`
+	Keyframes     []LightKeyframe `json:"keyframes"`
 	Samples       []Vector
 }
 
 // Camera structure.
 type Camera struct {
-	Position    Vector  `json:"position"`
-	Target      Vector  `json:"target"`
-	Up          Vector  `json:"up"`
-	Fov         float64 `json:"fov"`
-	AspectRatio float64 `json:"aspect_ratio"`
-	Zoom        float64 `json:"zoom"`
-	Near        float64 `json:"near"`
-	Far         float64 `json:"far"`
-	Perspective bool    `json:"perspective"`
-	Projection  *Matrix `json:"projection"`
-	view        Matrix
-	width       int
-	height      int
+	Position    Vector           `json:"position"`
+	Target      Vector           `json:"target"`
+	Up          Vector           `json:"up"`
+	Fov         float64          `json:"fov"`
+	AspectRatio float64          `json:"aspect_ratio"`
+	Zoom        float64          `json:"zoom"`
+	Near        float64          `json:"near"`
+	Far         float64          `json:"far"`
+	Perspective *bool            `json:"perspective"`
+	Projection  *Matrix          `json:"projection"`
+	Keyframes   []CameraKeyframe `json:"keyframes"`
+	// Type is perspective, orthographic, equirectangular or fisheye. If
+	// not set cameras are perspective unless the perspective flag is false.
+	// Ortho scale is the larger side of the orthographic view in scene
+	// units, fisheye uses fov as the full angle of its circle.
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	OrthoScale float64 `json:"ortho_scale"`
+	CubeLayout string  `json:"cube_layout"`
+	// Stereo is side_by_side or top_bottom, convergence distance is
+	// the camera target distance if not set.
+	Stereo              string  `json:"stereo"`
+	InterocularDistance float64 `json:"interocular_distance"`
+	ConvergenceDistance float64 `json:"convergence_distance"`
+	// Thin lens depth of field, off while aperture and f-stop are 0.
+	// Aperture is the lens radius in scene units, f-stop derives it from
+	// the focal length in millimeters (from fov with a 24mm sensor if 0)
+	// for scenes in meters. ISO and shutter speed in seconds with the
+	// f-stop set the exposure.
+	Aperture      float64 `json:"aperture"`
+	FStop         float64 `json:"f_stop"`
+	ISO           float64 `json:"iso"`
+	ShutterSpeed  float64 `json:"shutter_speed"`
+	FocalLength   float64 `json:"focal_length"`
+	FocusDistance float64 `json:"focus_distance"`
+	FocusPoint    *Vector `json:"focus_point"`
+	FocusObject   string  `json:"focus_object"`
+	BokehBlades   int     `json:"bokeh_blades"`
+	BokehRotation float64 `json:"bokeh_rotation"`
+	motion        *cameraMotion
+	view          Matrix
+	width         int
+	height        int
+	lensRadius    float64
+	focusDistance float64
+	orthoWidth    float64
+	orthoHeight   float64
+	convergence   float64
 }
 
 // PixelStorage to Store pixel information before turning it into a png
@@ -51,105 +85,168 @@ type Camera struct {
 type PixelStorage struct {
 	WorldLocation     Intersection
 	DirectLightEnergy Vector
+	IndirectLight     Vector
 	Color             Vector
 	AmbientColor      Vector
+	Albedo            Vector
+	Normal            Vector
+	Position          Vector
+	Reflection        Vector
+	Refraction        Vector
+	UV                Vector
+	Accumulated       Vector
+	Occlusion         float64
+	LuminanceSum      float64
+	LuminanceSquares  float64
 	Depth             float64
+	ObjectID          int64
+	MaterialID        int64
+	Samples           int
 	X                 int
 	Y                 int
 }
 
 // Scene main structure.
 type Scene struct {
-	Objects        map[string]*Object `json:"objects"`
-	MasterObject   *Object
-	Lights         []Light  `json:"lights"`
-	Cameras        []Camera `json:"observers"`
-	Pixels         [][]PixelStorage
-	Width          int
-	Height         int
-	ShortRadius    float64
-	InputFilename  string
-	OutputFilename string
+	Objects            map[string]*Object `json:"objects"`
+	MasterObject       *Object
+	Lights             []Light  `json:"lights"`
+	Cameras            []Camera `json:"observers"`
+	Config             Config   `json:"-"`
+	Reporter           Reporter `json:"-"`
+	Pixels             [][]PixelStorage
+	Width              int
+	Height             int
+	ShortRadius        float64
+	InputFilename      string
+	OutputFilename     string
+	OutputFormat       string
+	PreviewFilename    string
+	CheckpointFilename string
+	Resume             bool
+	Region             Region
+	Crop               bool
+	Frames             []int
+	CameraName         string
+	AllCameras         bool
+	cameraIndex        int
+	sceneHash          string
+	environmentMap     string
+	root               string // textures and maps must be under root when set
+	frameWidth         int
+	frameHeight        int
+	animation          bool
+	frame              float64
+	sceneLightCount    int
+	objectIDs          map[string]int64
+	exposure           float64
+	// Render state loaded once per scene, so scenes can render side by side.
+	images         map[string][][]Vector
+	bumpMaps       map[string][][]Vector
+	environment    [][]Vector
+	sampler        Sampler
+	lastTriangleID int64
 }
 
 // Init scene.
-func (s *Scene) Init(sceneFile, configFile, environmentMap string) error {
-	log.Print("Initializing the scene")
+func (s *Scene) Init(ctx context.Context, sceneFile, configFile, environmentMap string) error {
+	s.logf("Initializing the scene")
 	if configFile == "" {
-		log.Print("No config set, setting defaults")
-		GlobalConfig = DEFAULT
+		s.logf("No config set, setting defaults")
+		s.Config = DEFAULT
 	} else {
-		err := loadConfig(configFile)
+		s.logf("Loading configuration from %s", configFile)
+		config, err := LoadConfig(configFile)
 		if err != nil {
 			return err
 		}
+		s.Config = config
 	}
-	if GlobalConfig.EnvironmentMap != "" && environmentMap == "" {
-		environmentMap = GlobalConfig.EnvironmentMap
+	return s.load(ctx, sceneFile, environmentMap)
+}
+
+// load the scene file with its environment map, configuration must be set.
+func (s *Scene) load(ctx context.Context, sceneFile, environmentMap string) error {
+	if s.Config.EnvironmentMap != "" && environmentMap == "" {
+		environmentMap = s.Config.EnvironmentMap
 	}
 	if environmentMap != "" {
-		s.loadEnvironmentMap(environmentMap)
+		s.environmentMap = environmentMap
+		if err := s.loadEnvironmentMap(environmentMap); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	return s.loadJSON(sceneFile)
 }
 
-func (s *Scene) loadEnvironmentMap(mapFilename string) {
+func (s *Scene) loadEnvironmentMap(mapFilename string) error {
+	if err := s.checkRoot(mapFilename); err != nil {
+		return &TextureError{Texture: mapFilename, Err: err}
+	}
 	imageFile, err := os.Open(mapFilename)
 	if err != nil {
-		log.Printf("Environment Map [%s] can't be opened\n", mapFilename)
-		imageFile.Close() // defer has over-head
-		return
+		return &TextureError{Texture: mapFilename, Err: err}
 	}
 	src, _, err := image.Decode(imageFile)
+	imageFile.Close()
 	if err != nil {
-		log.Printf("Error reading image file [%s]: [%s]\n", mapFilename, err.Error())
-		imageFile.Close()
-		return
+		return &TextureError{Texture: mapFilename, Err: err}
 	}
 
 	imgBounds := src.Bounds().Max
-	EnvironmentMap = make([][]Vector, imgBounds.X)
+	s.environment = make([][]Vector, imgBounds.X)
 	for i := 0; i < imgBounds.X; i++ {
-		EnvironmentMap[i] = make([]Vector, imgBounds.Y)
+		s.environment[i] = make([]Vector, imgBounds.Y)
 		for j := 0; j < imgBounds.Y; j++ {
 			r, g, b, a := src.At(i, j).RGBA()
 			r, g, b, a = r>>8, g>>8, b>>8, a>>8
 
+			// Color images are sRGB encoded, we render in linear space.
 			result := Vector{
-				float64(r) / 255,
-				float64(g) / 255,
-				float64(b) / 255,
+				srgbToLinearTable[r],
+				srgbToLinearTable[g],
+				srgbToLinearTable[b],
 				float64(a) / 255,
 			}
-			EnvironmentMap[i][j] = result
+			s.environment[i][j] = result
 		}
 	}
-	imageFile.Close()
-	hasEnvironmentMap = true
+	return nil
 }
 
 func (s *Scene) loadJSON(jsonFile string) error {
 	start := time.Now()
-	log.Printf("Loading file: %s\n", jsonFile)
+	s.logf("Loading file: %s\n", jsonFile)
 	file, err := ioutil.ReadFile(jsonFile)
 	if err != nil {
-		log.Fatalf("Error while reading file: %s", err.Error())
-		return err
+		return fmt.Errorf("can't read scene: %w", err)
 	}
-	log.Printf("Unmarshal JSON\n")
+	s.logf("Unmarshal JSON\n")
 	err = json.Unmarshal(file, &s)
 	if err != nil {
-		log.Fatalf("Error unmarshalling %s", err.Error())
-		return err
+		return fmt.Errorf("can't parse scene %s: %w", jsonFile, err)
 	}
 	s.InputFilename = jsonFile
-	log.Printf("Fixing object Ws\n")
+	hash := sha256.Sum256(file)
+	s.sceneHash = hex.EncodeToString(hash[:])
+	s.logf("Fixing object Ws\n")
 	for name := range s.Objects {
 		s.Objects[name].fixW()
 		s.Objects[name].calcRadius()
 	}
+	storeLocalMatrices(s.Objects)
+	if err := s.checkCameras(); err != nil {
+		return err
+	}
+	if err := s.checkAnimation(); err != nil {
+		return err
+	}
+	s.animation = s.hasKeyframes()
 
-	log.Printf("Loaded scene in %f seconds\n", time.Since(start).Seconds())
+	s.logf("Loaded scene in %f seconds\n", time.Since(start).Seconds())
 	return nil
 }
 
@@ -159,97 +256,145 @@ func (s *Scene) mergeAll() {
 	}
 	gigaMesh.Materials = make(map[string]Material)
 	gigaMesh.Triangles = make([]Triangle, 0)
-	for obj := range s.Objects {
+	// Sorted, so triangles and their lights are in the same order every run.
+	names := make([]string, 0, len(s.Objects))
+	for name := range s.Objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, obj := range names {
 		for k, m := range s.Objects[obj].Materials {
 			gigaMesh.Materials[k] = m
 		}
 		gigaMesh.Triangles = append(gigaMesh.Triangles, s.Objects[obj].Triangles...)
-		s.Objects[obj] = nil
+		// Animated scenes keep objects to move them in next frames.
+		if !s.animation {
+			s.Objects[obj] = nil
+		}
 	}
 	gigaMesh.calcRadius()
-	log.Printf("Build KDTree")
-	gigaMesh.KDTree()
-	log.Printf("Built %d nodes with %d max depth, object ready", totalNodes, maxDepth)
-	s.Objects = nil
+	s.logf("Build KDTree")
+	stats := gigaMesh.KDTree()
+	s.logf("Built %d nodes with %d max depth, object ready", stats.nodes, stats.maxDepth)
+	if !s.animation {
+		s.Objects = nil
+	}
 	s.MasterObject = &gigaMesh
 }
 
-func (s *Scene) prepare(width, height int) {
-	s.Width = width
-	s.Height = height
+// prepare the scene geometry once for all cameras. Cameras are set up
+// by useCamera and pixels are scanned later by setRegion.
+func (s *Scene) prepare(ctx context.Context) error {
 	// Order of below calls is important!
-	log.Printf("Init scene")
+	s.logf("Init scene")
+	sampler, err := newSampler(&s.Config)
+	if err != nil {
+		return err
+	}
+	s.sampler = sampler
+	switch s.Config.HemisphereSampling {
+	case HemisphereCosine, HemisphereUniform, "":
+	default:
+		return fmt.Errorf("unknown hemisphere sampling %s", s.Config.HemisphereSampling)
+	}
 	s.flatten()
-	// log.Printf("After flatten")
+	s.poseCamerasAndLights()
+	// s.logf("After flatten")
 	// PrintMemUsage()
-	s.processObjects()
-	// log.Printf("After objects processing")
+	if err := s.processObjects(ctx); err != nil {
+		return err
+	}
+	// s.logf("After objects processing")
 	// PrintMemUsage()
 	s.mergeAll()
-	// log.Printf("After mergeall")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// s.logf("After mergeall")
 	// PrintMemUsage()
-	s.parseMaterials()
+	if err := s.parseMaterials(); err != nil {
+		return err
+	}
 	s.fixLightPos()
+	s.sceneLightCount = len(s.Lights)
 	s.loadLights()
-	s.prepareMatrices()
-	log.Printf("After parse materials")
-	PrintMemUsage()
-	s.scanPixels()
-	log.Printf("When we prep scene")
-	PrintMemUsage()
-	if GlobalConfig.RenderCaustics {
-		s.buildPhotonMap()
-	}
-	log.Printf("Done init scene")
+	s.logf("After parse materials")
+	s.logMemUsage()
+	if s.Config.RenderCaustics {
+		if err := s.buildPhotonMap(ctx); err != nil {
+			return err
+		}
+	}
+	s.logf("Done init scene")
+	return nil
 }
 
 func (s *Scene) prepareMatrices() {
-	view := viewMatrix(s.Cameras[0].Position, s.Cameras[0].Target, s.Cameras[0].Up)
+	camera := s.camera()
+	view := viewMatrix(camera.Position, camera.Target, camera.Up)
+	// Stereo eyes and cube faces are views into a part of the frame.
+	width, height := camera.viewSize(s.frameWidth, s.frameHeight)
 	projectionMatrix := perspectiveProjection(
-		s.Cameras[0].Fov,
-		float64(s.Width)/float64(s.Height),
-		s.Cameras[0].Near,
-		s.Cameras[0].Far,
+		camera.Fov,
+		float64(width)/float64(height),
+		camera.Near,
+		camera.Far,
 	)
-	if s.Cameras[0].Projection == nil {
-		s.Cameras[0].Projection = &projectionMatrix
+	if camera.Projection == nil {
+		camera.Projection = &projectionMatrix
 	}
 
-	s.Cameras[0].view = view
-	s.Cameras[0].width = s.Width
-	s.Cameras[0].height = s.Height
+	camera.view = view
+	camera.width = width
+	camera.height = height
+	camera.prepareProjection()
+	s.focus(camera)
 }
 
-func (s *Scene) scanPixels() {
-	log.Printf("Scanning pixels on view")
-	bar := pb.StartNew(s.Width * s.Height)
+func (s *Scene) allocatePixels() {
 	s.Pixels = make([][]PixelStorage, s.Width)
 	for i := 0; i < s.Width; i++ {
 		s.Pixels[i] = make([]PixelStorage, s.Height)
 		for j := 0; j < s.Height; j++ {
-			s.Pixels[i][j].Color = GlobalConfig.TransparentColor
+			s.Pixels[i][j].Color = s.Config.TransparentColor
 		}
 	}
-	log.Println("After pixel storage")
-	PrintMemUsage()
+}
+
+func (s *Scene) scanPixels(ctx context.Context) error {
+	s.logf("Scanning pixels on view")
+	stage := s.startStage(StageScan, s.Width*s.Height)
+	s.allocatePixels()
+	s.logf("After pixel storage")
+	s.logMemUsage()
 
 	for i := 0; i < s.Width; i++ {
+		if err := ctx.Err(); err != nil {
+			stage.finish()
+			return err
+		}
 		for j := 0; j < s.Height; j++ {
-			rayDir := screenToWorld(i, j, s.Width, s.Height, s.Cameras[0].Position, *s.Cameras[0].Projection, s.Cameras[0].view)
-			bestHit := raycastSceneIntersect(s, s.Cameras[0].Position, rayDir)
-			s.Pixels[i][j].WorldLocation = bestHit
-			bar.Increment()
+			x, y := i+s.Region.Left, j+s.Region.Top
+			// Scanned rays are the first samples of the pixels.
+			sample := s.pixelSample(i, j, 0)
+			rayStart, rayDir, ok := s.cameraRay(float64(x), float64(y), shutterCenter, s.lensPoint(sample))
+			if ok {
+				s.Pixels[i][j].WorldLocation = raycastSceneIntersect(s, rayStart, rayDir, shutterCenter)
+			}
+			s.Pixels[i][j].WorldLocation.sample = sample
+			stage.increment()
 		}
 	}
-	log.Printf("After pixel raycasts")
-	PrintMemUsage()
-	bar.Finish()
-	log.Printf("Done scanning pixels")
+	s.logf("After pixel raycasts")
+	s.logMemUsage()
+	stage.finish()
+	s.logf("Done scanning pixels")
+	return nil
 }
 
-func (s *Scene) buildPhotonMap() {
-	log.Print("Building photon map")
-	buildPhotonMap(s)
+func (s *Scene) buildPhotonMap(ctx context.Context) error {
+	s.logf("Building photon map")
+	return buildPhotonMap(ctx, s)
 }
 
 func (s *Scene) loadLights() {
@@ -258,7 +403,8 @@ func (s *Scene) loadLights() {
 			continue
 		}
 		mat := s.MasterObject.Triangles[i].Material
-		lights := sampleTriangle(s.MasterObject.Triangles[i], GlobalConfig.LightSampleCount)
+		seed := s.random(streamLight, uint64(i))
+		lights := sampleTriangle(s.sampler, seed.next(), s.MasterObject.Triangles[i], s.Config.LightSampleCount)
 		strength := s.MasterObject.Triangles[i].Material.LightStrength
 		for li := range lights {
 			light := Light{
@@ -271,6 +417,12 @@ func (s *Scene) loadLights() {
 			s.Lights = append(s.Lights, light)
 		}
 	}
+	for i := range s.Lights {
+		if s.Lights[i].Directional && s.Lights[i].Samples == nil {
+			seed := s.random(streamSun, uint64(i))
+			s.Lights[i].Samples = sampleSphere(s.sampler, seed.next(), sunRadius, s.Config.LightSampleCount)
+		}
+	}
 }
 
 // Lights have 0 as w but they are not vectors, they are positions;
@@ -282,7 +434,7 @@ func (s *Scene) fixLightPos() {
 }
 
 func (s *Scene) flatten() {
-	log.Printf("Flatten Scene Objects\n")
+	s.logf("Flatten Scene Objects\n")
 	s.Objects = flattenSceneObjects(s.Objects)
 }
 
@@ -297,6 +449,7 @@ func flattenSceneObjects(objects map[string]*Object) map[string]*Object {
 			for subKey := range flatList {
 				subObj := flatList[subKey]
 				subObj.Matrix = multiplyMatrix(subObj.Matrix, objects[k].Matrix)
+				subObj.parents = append(subObj.parents, objects[k])
 				result[k+subKey] = subObj
 			}
 		}
@@ -305,23 +458,58 @@ func flattenSceneObjects(objects map[string]*Object) map[string]*Object {
 }
 
 // TODO: This is a bit heavy, refactor.
-func (s *Scene) processObjects() {
-	log.Printf("Transform object vertices to absolute and build KDTrees")
+func (s *Scene) processObjects(ctx context.Context) error {
+	s.logf("Transform object vertices to absolute and build KDTrees")
 
+	// Give objects and materials stable ids for the id render passes.
+	objectNames := make([]string, 0, len(s.Objects))
+	materialIDs := make(map[string]int64)
+	materialNames := make([]string, 0)
 	for k := range s.Objects {
-		log.Printf("Prepare object %s", k)
+		objectNames = append(objectNames, k)
+		for m := range s.Objects[k].Materials {
+			if _, ok := materialIDs[m]; !ok {
+				materialIDs[m] = 0
+				materialNames = append(materialNames, m)
+			}
+		}
+	}
+	sort.Strings(objectNames)
+	sort.Strings(materialNames)
+	for i := range materialNames {
+		materialIDs[materialNames[i]] = int64(i + 1)
+	}
+
+	s.objectIDs = make(map[string]int64)
+	for index, k := range objectNames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.logf("Prepare object %s", k)
 		obj := s.Objects[k]
-		log.Printf("Local to absolute")
-		absoluteVertices := localToAbsoluteList(obj.Vertices, obj.Matrix)
-		for i := 0; i < len(absoluteVertices); i++ {
-			obj.Vertices[i] = absoluteVertices[i]
+		if err := obj.checkIndices(k); err != nil {
+			return err
+		}
+		obj.id = int64(index + 1)
+		s.objectIDs[k] = obj.id
+		for m, mat := range obj.Materials {
+			mat.id = materialIDs[m]
+			obj.Materials[m] = mat
+		}
+		s.logf("Unify triangles")
+		obj.UnifyTriangles(&s.lastTriangleID)
+		s.logf("Loaded object with %d triangles", len(obj.Triangles))
+		s.logf("Local to absolute")
+		obj.world, obj.worldEnd = s.shutterMatrices(obj)
+		if obj.animated() {
+			// Keep local triangles to transform them again for next frames.
+			obj.localTriangles = obj.Triangles
+			obj.Triangles = make([]Triangle, len(obj.localTriangles))
 		}
-		log.Printf("Unify triangles")
-		obj.UnifyTriangles()
-		totalNodes = 0
-		maxDepth = 0
+		obj.transformTriangles()
 		s.Objects[k] = obj
 	}
+	return nil
 }
 
 // Parse all material images and store them in scene object
@@ -329,19 +517,25 @@ func (s *Scene) processObjects() {
 // TODO: Free material image if it is not being used.
 // TODO: This method is complex and has more than one responsibility
 // NOTE: This function assumes that objects are already flattened!
-func (s *Scene) parseMaterials() {
-	log.Printf("Parse material textures\n")
+func (s *Scene) parseMaterials() error {
+	s.logf("Parse material textures\n")
 	scenePath := filepath.Dir(s.InputFilename)
-	BumpMapNormals = make(map[string][][]Vector)
-	Images = make(map[string][][]Vector)
+	s.bumpMaps = make(map[string][][]Vector)
+	s.images = make(map[string][][]Vector)
 	for m := range s.MasterObject.Materials {
 		mat := s.MasterObject.Materials[m]
-		if _, ok := Images[mat.Texture]; ok {
+		if _, ok := s.images[mat.Texture]; ok {
+			continue
+		}
+		if mat.Texture == "" {
 			continue
 		}
-		if mat.Texture != "" {
-			loadImage(scenePath, mat.Texture)
-			loadBumpMap(scenePath, mat.Texture)
+		if err := s.loadImage(scenePath, mat.Texture); err != nil {
+			return err
+		}
+		if err := s.loadBumpMap(scenePath, mat.Texture); err != nil {
+			return err
 		}
 	}
+	return nil
 }
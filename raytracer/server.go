@@ -0,0 +1,731 @@
+package raytracer
+
+/*
+Job server runs raylar as a local render service. Jobs name a scene file
+on the server or upload one with its textures, override configuration
+values and wait in a queue until one of the render slots picks them up.
+Status, progress, previews and outputs are served over HTTP. Finished
+jobs and their files are removed after the retention time or on DELETE.
+Scenes named by path and the files they use must be under the scene root,
+uploaded scenes can only use their own files:
+
+	POST   /jobs                  submit a job, JSON or multipart upload
+	GET    /jobs                  list jobs
+	GET    /jobs/<id>             job status and progress
+	DELETE /jobs/<id>             cancel a queued or running job, remove a finished one
+	GET    /jobs/<id>/preview     png of the pixels rendered so far
+	GET    /jobs/<id>/image       the rendered image
+	GET    /jobs/<id>/files/<name> other outputs, like render passes
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	JobQueued    = "queued"
+	JobRendering = "rendering"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// maxUploadMemory is kept in memory while reading uploads, the rest goes to temporary files.
+const maxUploadMemory = 32 << 20
+
+// JobRequest is the JSON body of a job submission. Multipart uploads send
+// the same values as form fields, the scene as a "scene" file and other
+// files named by their path relative to the scene.
+type JobRequest struct {
+	Scene          string          `json:"scene"`
+	Camera         string          `json:"camera"`
+	Format         string          `json:"format"`
+	EnvironmentMap string          `json:"environment_map"`
+	Config         json.RawMessage `json:"config"`
+}
+
+// Job is a queued, running or finished render.
+type Job struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Scene     string     `json:"scene"`
+	Camera    string     `json:"camera,omitempty"`
+	Format    string     `json:"format"`
+	Error     string     `json:"error,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Stage     string     `json:"stage,omitempty"`
+	Done      int        `json:"done"`
+	Total     int        `json:"total"`
+	ETA       float64    `json:"eta"`
+	Message   string     `json:"message,omitempty"`
+	Outputs   []string   `json:"outputs,omitempty"`
+
+	config         Config
+	environmentMap string
+	root           string
+	dir            string
+	cancel         context.CancelFunc
+	preview        *Image
+}
+
+// JobServer queues jobs and renders them concurrency at a time. Jobs
+// finished longer than Retention ago are removed, 0 keeps them. Jobs can
+// name scenes under Root by path, without a Root they have to upload them.
+// Server events go to the Reporter, job messages are kept in their status.
+type JobServer struct {
+	sync.Mutex
+	Config      Config
+	Retention   time.Duration
+	Root        string
+	Reporter    Reporter
+	dir         string
+	concurrency int
+	jobs        map[string]*Job
+	order       []string
+	queue       []*Job
+	wake        *sync.Cond
+}
+
+// NewJobServer keeping job files under dir. Config is the base
+// configuration of the jobs, they can override its values.
+func NewJobServer(config Config, dir string, concurrency int) *JobServer {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	js := &JobServer{
+		Config:      config,
+		dir:         dir,
+		concurrency: concurrency,
+		jobs:        make(map[string]*Job),
+		Reporter:    NewTerminalReporter(),
+	}
+	js.wake = sync.NewCond(js)
+	return js
+}
+
+// ListenAndServe renders queued jobs and answers requests on the host and
+// port until ctx is done.
+func (js *JobServer) ListenAndServe(ctx context.Context, host string, port int) error {
+	if err := os.MkdirAll(js.dir, 0755); err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	server := &http.Server{Addr: addr, Handler: js.Handler()}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < js.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			js.work(ctx)
+		}()
+	}
+	if js.Retention > 0 {
+		go js.expire(ctx)
+	}
+	js.logf("Job server listening on %s, rendering %d jobs at a time", addr, js.concurrency)
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err()
+		_ = server.Shutdown(context.Background())
+	}
+	js.Lock()
+	js.wake.Broadcast()
+	js.Unlock()
+	wg.Wait()
+	return err
+}
+
+// Handler serves the job API.
+func (js *JobServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", js.handleJobs)
+	mux.HandleFunc("/jobs/", js.handleJob)
+	return mux
+}
+
+func (js *JobServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		js.Lock()
+		jobs := make([]Job, 0, len(js.order))
+		for _, id := range js.order {
+			jobs = append(jobs, *js.jobs[id])
+		}
+		js.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		job, err := js.submit(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		js.Lock()
+		status := *job
+		js.Unlock()
+		writeJSON(w, http.StatusCreated, status)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (js *JobServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/", 2)
+	js.Lock()
+	job, ok := js.jobs[parts[0]]
+	js.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		js.Lock()
+		status := *job
+		js.Unlock()
+		writeJSON(w, http.StatusOK, status)
+	case action == "" && r.Method == http.MethodDelete:
+		js.Lock()
+		finished := job.Finished != nil
+		js.Unlock()
+		if finished {
+			if err := js.removeJob(job); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		js.cancelJob(job)
+		js.Lock()
+		status := *job
+		js.Unlock()
+		writeJSON(w, http.StatusOK, status)
+	case action == "preview" && r.Method == http.MethodGet:
+		js.servePreview(w, job)
+	case action == "image" && r.Method == http.MethodGet:
+		js.Lock()
+		outputs := job.Outputs
+		js.Unlock()
+		if len(outputs) == 0 {
+			http.Error(w, "job has no image yet", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(job.dir, "output", outputs[0]))
+	case strings.HasPrefix(action, "files/") && r.Method == http.MethodGet:
+		name := strings.TrimPrefix(action, "files/")
+		js.Lock()
+		found := false
+		for _, output := range job.Outputs {
+			found = found || output == name
+		}
+		js.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(job.dir, "output", name))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// submit reads the job request, stores uploaded files and queues the job.
+func (js *JobServer) submit(r *http.Request) (*Job, error) {
+	dir, err := ioutil.TempDir(js.dir, "job")
+	if err != nil {
+		return nil, err
+	}
+	var req JobRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = readUpload(r, dir, &req)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&req)
+	}
+	if err == nil {
+		err = req.validate()
+	}
+	root := dir
+	if err == nil && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		root = js.Root
+		err = req.resolve(root)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	config, err := overrideConfig(js.Config, req.Config)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if req.Format == "" {
+		req.Format = FormatPNG
+	}
+	job := &Job{
+		ID:             filepath.Base(dir),
+		Status:         JobQueued,
+		Scene:          req.Scene,
+		Camera:         req.Camera,
+		Format:         req.Format,
+		Submitted:      time.Now(),
+		config:         config,
+		environmentMap: req.EnvironmentMap,
+		root:           root,
+		dir:            dir,
+	}
+	js.Lock()
+	js.jobs[job.ID] = job
+	js.order = append(js.order, job.ID)
+	js.queue = append(js.queue, job)
+	js.wake.Signal()
+	js.Unlock()
+	js.logf("Job %s queued for %s", job.ID, job.Scene)
+	return job, nil
+}
+
+func (req *JobRequest) validate() error {
+	if req.Scene == "" {
+		return fmt.Errorf("job has no scene")
+	}
+	if req.Format != formatNotSet {
+		if _, err := outputFormat("", req.Format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve the scene and environment map paths under root.
+func (req *JobRequest) resolve(root string) error {
+	if root == "" {
+		return fmt.Errorf("scene paths are disabled, upload the scene instead")
+	}
+	var err error
+	if req.Scene, err = rootPath(root, req.Scene); err != nil {
+		return err
+	}
+	if req.EnvironmentMap != "" {
+		req.EnvironmentMap, err = rootPath(root, req.EnvironmentMap)
+	}
+	return err
+}
+
+// readUpload saves the uploaded scene and its files into dir, paths of
+// the request point to the saved files.
+func readUpload(r *http.Request, dir string, req *JobRequest) error {
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return err
+	}
+	defer r.MultipartForm.RemoveAll()
+	req.Camera = r.FormValue("camera")
+	req.Format = r.FormValue("format")
+	if config := r.FormValue("config"); config != "" {
+		req.Config = json.RawMessage(config)
+	}
+	if _, ok := r.MultipartForm.File["scene"]; !ok {
+		return fmt.Errorf("upload has no scene file")
+	}
+	for name, headers := range r.MultipartForm.File {
+		filename := filepath.Join(dir, "scene.json")
+		if name != "scene" {
+			var err error
+			if filename, err = uploadPath(dir, name); err != nil {
+				return err
+			}
+		}
+		if err := saveUpload(headers[0], filename); err != nil {
+			return err
+		}
+	}
+	req.Scene = filepath.Join(dir, "scene.json")
+	if environmentMap := r.FormValue("environment_map"); environmentMap != "" {
+		var err error
+		if req.EnvironmentMap, err = uploadPath(dir, environmentMap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadPath of an uploaded file, names are relative to the scene.
+func uploadPath(dir, name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("%s is outside of the scene directory", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// rootPath of a file named by a job, relative names are under root.
+func rootPath(root, name string) (string, error) {
+	filename := name
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(root, filename)
+	}
+	if err := insideRoot(root, filename); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// insideRoot checks that the file, following links, is under root.
+func insideRoot(root, filename string) error {
+	resolvedRoot, err := resolvePath(root)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolvePath(filename)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of %s", filename, root)
+	}
+	return nil
+}
+
+// resolvePath is the absolute path of the file with links followed.
+func resolvePath(filename string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
+
+func saveUpload(header *multipart.FileHeader, filename string) error {
+	src, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	dst, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	cerr := dst.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// overrideConfig sets the values of the JSON object over the base configuration.
+func overrideConfig(base Config, overrides json.RawMessage) (Config, error) {
+	config := base
+	if len(overrides) == 0 {
+		return config, nil
+	}
+	if err := json.Unmarshal(overrides, &config); err != nil {
+		return config, fmt.Errorf("can't read config overrides: %w", err)
+	}
+	return config, nil
+}
+
+// cancelJob drops a queued job or stops a running one.
+func (js *JobServer) cancelJob(job *Job) {
+	js.Lock()
+	defer js.Unlock()
+	switch job.Status {
+	case JobQueued:
+		for i := range js.queue {
+			if js.queue[i] == job {
+				js.queue = append(js.queue[:i], js.queue[i+1:]...)
+				break
+			}
+		}
+		now := time.Now()
+		job.Status = JobCancelled
+		job.Finished = &now
+	case JobRendering:
+		job.cancel()
+	}
+}
+
+// removeJob forgets a finished job and deletes its files.
+func (js *JobServer) removeJob(job *Job) error {
+	js.Lock()
+	delete(js.jobs, job.ID)
+	for i, id := range js.order {
+		if id == job.ID {
+			js.order = append(js.order[:i], js.order[i+1:]...)
+			break
+		}
+	}
+	js.Unlock()
+	js.logf("Job %s removed", job.ID)
+	return os.RemoveAll(job.dir)
+}
+
+// expire removes jobs finished longer than the retention ago until ctx is done.
+func (js *JobServer) expire(ctx context.Context) {
+	interval := js.Retention / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		js.Lock()
+		expired := make([]*Job, 0)
+		for _, id := range js.order {
+			job := js.jobs[id]
+			if job.Finished != nil && time.Since(*job.Finished) >= js.Retention {
+				expired = append(expired, job)
+			}
+		}
+		js.Unlock()
+		for _, job := range expired {
+			if err := js.removeJob(job); err != nil {
+				js.logf("Can't remove job %s: %s", job.ID, err.Error())
+			}
+		}
+	}
+}
+
+// work renders queued jobs until ctx is done.
+func (js *JobServer) work(ctx context.Context) {
+	for {
+		job, jobCtx := js.next(ctx)
+		if job == nil {
+			return
+		}
+		err := js.render(jobCtx, job)
+		// Checked before the job context is released, which cancels it.
+		stopped := jobCtx.Err() != nil
+		job.cancel()
+
+		js.Lock()
+		now := time.Now()
+		job.Finished = &now
+		switch {
+		case err == nil:
+			job.Status = JobDone
+		case stopped:
+			job.Status = JobCancelled
+		default:
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+		job.Outputs = listOutputs(filepath.Join(job.dir, "output"), job.Format)
+		status, message := job.Status, job.Error
+		js.Unlock()
+		if message != "" {
+			js.logf("Job %s %s: %s", job.ID, status, message)
+		} else {
+			js.logf("Job %s %s", job.ID, status)
+		}
+	}
+}
+
+// next waits for a queued job and marks it rendering.
+func (js *JobServer) next(ctx context.Context) (*Job, context.Context) {
+	js.Lock()
+	defer js.Unlock()
+	for len(js.queue) == 0 {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		js.wake.Wait()
+	}
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+	job := js.queue[0]
+	js.queue = js.queue[1:]
+	jobCtx, cancel := context.WithCancel(ctx)
+	now := time.Now()
+	job.Status = JobRendering
+	job.Started = &now
+	job.cancel = cancel
+	return job, jobCtx
+}
+
+// render the job scene into its output directory.
+func (js *JobServer) render(ctx context.Context, job *Job) error {
+	output := filepath.Join(job.dir, "output")
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	reporter := &jobReporter{server: js, job: job}
+	scene := &Scene{
+		Config:         job.config,
+		Reporter:       reporter,
+		OutputFilename: filepath.Join(output, "render."+formatExtension(job.Format)),
+		OutputFormat:   job.Format,
+		CameraName:     job.Camera,
+		root:           job.root,
+	}
+	reporter.scene = scene
+	if err := scene.load(ctx, job.Scene, job.environmentMap); err != nil {
+		return err
+	}
+	size := ""
+	return Render(ctx, scene, nil, scene.Config.Percentage, &size)
+}
+
+// formatExtension is the file extension of the output format.
+func formatExtension(format string) string {
+	if format == FormatPNG16 {
+		return "png"
+	}
+	return format
+}
+
+// listOutputs of the job, the main image of the format first.
+func listOutputs(dir, format string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	main := "render." + formatExtension(format)
+	outputs := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".checkpoint") {
+			continue
+		}
+		outputs = append(outputs, f.Name())
+	}
+	sort.SliceStable(outputs, func(i, j int) bool {
+		return outputs[i] == main && outputs[j] != main
+	})
+	return outputs
+}
+
+func (js *JobServer) servePreview(w http.ResponseWriter, job *Job) {
+	js.Lock()
+	var preview *Image
+	if job.preview != nil {
+		copied := *job.preview
+		copied.Pixels = append([]Vector(nil), job.preview.Pixels...)
+		preview = &copied
+	}
+	js.Unlock()
+	if preview == nil {
+		http.Error(w, "job has no preview yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, preview.RGBA()); err != nil {
+		js.logf("Can't write preview of job %s: %s", job.ID, err.Error())
+	}
+}
+
+// logf sends a server event to the reporter.
+func (js *JobServer) logf(format string, args ...interface{}) {
+	js.Reporter.Message(fmt.Sprintf(format, args...))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// jobReporter keeps the progress and preview pixels of a job.
+type jobReporter struct {
+	server *JobServer
+	job    *Job
+	scene  *Scene
+}
+
+func (r *jobReporter) StageStarted(stage string, total int) {
+	r.server.Lock()
+	defer r.server.Unlock()
+	r.job.Stage = stage
+	r.job.Done = 0
+	r.job.Total = total
+	r.job.ETA = 0
+}
+
+func (r *jobReporter) Progress(stage string, done, total int, eta time.Duration) {
+	r.server.Lock()
+	defer r.server.Unlock()
+	r.job.Stage = stage
+	r.job.Done = done
+	r.job.Total = total
+	r.job.ETA = eta.Seconds()
+}
+
+func (r *jobReporter) StageFinished(stage string, elapsed time.Duration) {
+	r.server.Lock()
+	defer r.server.Unlock()
+	r.job.Done = r.job.Total
+	r.job.ETA = 0
+}
+
+// TileCompleted copies the tile into the preview, called while rendering
+// so the exposure can be metered from the scene like previews on disk.
+func (r *jobReporter) TileCompleted(tile Tile) {
+	if err := r.scene.meterExposure(); err != nil {
+		return
+	}
+	display, err := newDisplayTransform(r.scene)
+	if err != nil {
+		return
+	}
+	width, height := r.scene.frameWidth, r.scene.frameHeight
+	r.server.Lock()
+	defer r.server.Unlock()
+	preview := r.job.preview
+	if preview == nil || preview.Width != width || preview.Height != height {
+		preview = &Image{Width: width, Height: height, Pixels: make([]Vector, width*height)}
+		r.job.preview = preview
+	}
+	preview.display = display
+	i := 0
+	for y := tile.Top; y < tile.Bottom; y++ {
+		for x := tile.Left; x < tile.Right; x++ {
+			preview.Pixels[y*width+x] = tile.Pixels[i]
+			i++
+		}
+	}
+}
+
+// Message is kept as the last message of the job.
+func (r *jobReporter) Message(message string) {
+	r.server.Lock()
+	r.job.Message = message
+	r.server.Unlock()
+}
@@ -0,0 +1,106 @@
+package raytracer
+
+/*
+Stereo rendering. Both eyes go into one frame, side by side or top and
+bottom, left eye first. Eyes are moved apart along the camera side and
+aim at the same point on the convergence plane (off-axis stereo).
+Equirectangular cameras render omnidirectional stereo instead: the eyes
+move around a circle so every direction gets its own eye separation.
+*/
+
+import (
+	"fmt"
+	"math"
+)
+
+// Stereo layouts.
+const (
+	StereoSideBySide = "side_by_side"
+	StereoTopBottom  = "top_bottom"
+	stereoOff        = ""
+)
+
+// defaultInterocularDistance in meters.
+const defaultInterocularDistance = 0.065
+
+func checkStereo(c *Camera) error {
+	switch c.Stereo {
+	case stereoOff:
+		return nil
+	case StereoSideBySide, StereoTopBottom:
+	default:
+		return fmt.Errorf("camera %s has unknown stereo layout %s", c.Name, c.Stereo)
+	}
+	if c.Type == CameraCubeMap {
+		return fmt.Errorf("camera %s: stereo cube maps are not supported", c.Name)
+	}
+	if c.InterocularDistance <= 0 {
+		c.InterocularDistance = defaultInterocularDistance
+	}
+	return nil
+}
+
+// stereoFrameSize keeps the frame evenly split between the eyes.
+func (c *Camera) stereoFrameSize(width, height int) (int, int) {
+	switch c.Stereo {
+	case StereoSideBySide:
+		width -= width % 2
+	case StereoTopBottom:
+		height -= height % 2
+	}
+	return width, height
+}
+
+// eyeSize is the size of the image of one eye.
+func (c *Camera) eyeSize(width, height int) (int, int) {
+	switch c.Stereo {
+	case StereoSideBySide:
+		width /= 2
+	case StereoTopBottom:
+		height /= 2
+	}
+	return width, height
+}
+
+// eyeCoordinates maps frame coordinates to the coordinates in the eye's image.
+// Eye is -1 for left, 1 for right and 0 without stereo.
+func (c *Camera) eyeCoordinates(x, y float64) (float64, float64, float64) {
+	switch c.Stereo {
+	case StereoSideBySide:
+		if int(math.Floor(x+0.5)) >= c.width {
+			return x - float64(c.width), y, 1
+		}
+		return x, y, -1
+	case StereoTopBottom:
+		if int(math.Floor(y+0.5)) >= c.height {
+			return x, y - float64(c.height), 1
+		}
+		return x, y, -1
+	}
+	return x, y, 0
+}
+
+// stereoEye moves the center ray to the eye.
+func (c *Camera) stereoEye(eye float64, rayStart, rayDir Vector, view Matrix) (Vector, Vector) {
+	side, up, forward := viewAxes(view)
+	offset := eye * c.InterocularDistance / 2
+	if c.Type == CameraEquirectangular {
+		// Eyes sit on a circle, perpendicular to the horizontal ray direction.
+		horizontal := subVector(rayDir, scaleVector(up, dot(rayDir, up)))
+		if vectorLength(horizontal) < DIFF {
+			return rayStart, rayDir
+		}
+		tangent := normalizeVector(crossProduct(normalizeVector(horizontal), up))
+		eyeStart := addVector(rayStart, scaleVector(tangent, offset))
+		eyeStart[3] = rayStart[3]
+		return eyeStart, rayDir
+	}
+	eyeStart := addVector(rayStart, scaleVector(side, offset))
+	eyeStart[3] = rayStart[3]
+	along := dot(rayDir, forward)
+	if c.convergence <= 0 || along <= 0 {
+		return eyeStart, rayDir
+	}
+	target := addVector(rayStart, scaleVector(rayDir, c.convergence/along))
+	return eyeStart, normalizeVector(subVector(target, eyeStart))
+}
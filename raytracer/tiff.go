@@ -0,0 +1,103 @@
+package raytracer
+
+/*
+Minimal baseline TIFF writer for 16 bits per channel RGBA images.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"os"
+)
+
+// TIFF tags and field types we need.
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffExtraSamples    = 338
+
+	tiffShort = 3
+	tiffLong  = 4
+)
+
+type tiffEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value uint32
+}
+
+// writeTIFF16 stores the image uncompressed in a single strip.
+func writeTIFF16(filename string, img *image.NRGBA64) error {
+	width := img.Rect.Dx()
+	height := img.Rect.Dy()
+	dataSize := uint32(width * height * 8)
+
+	// Layout: header, pixel data, bits per sample array, IFD.
+	dataOffset := uint32(8)
+	bitsOffset := dataOffset + dataSize
+	ifdOffset := bitsOffset + 8
+
+	entries := []tiffEntry{
+		{tiffImageWidth, tiffLong, 1, uint32(width)},
+		{tiffImageLength, tiffLong, 1, uint32(height)},
+		{tiffBitsPerSample, tiffShort, 4, bitsOffset},
+		{tiffCompression, tiffShort, 1, 1},
+		{tiffPhotometric, tiffShort, 1, 2},
+		{tiffStripOffsets, tiffLong, 1, dataOffset},
+		{tiffSamplesPerPixel, tiffShort, 1, 4},
+		{tiffRowsPerStrip, tiffLong, 1, uint32(height)},
+		{tiffStripByteCounts, tiffLong, 1, dataSize},
+		{tiffPlanarConfig, tiffShort, 1, 1},
+		// Unassociated alpha
+		{tiffExtraSamples, tiffShort, 1, 2},
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	le := binary.LittleEndian
+	_, _ = w.Write([]byte{'I', 'I', 42, 0})
+	_ = binary.Write(w, le, ifdOffset)
+
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width*8]
+		// NRGBA64 keeps big endian samples.
+		for i := 0; i < len(row); i += 2 {
+			_, _ = w.Write([]byte{row[i+1], row[i]})
+		}
+	}
+	_ = binary.Write(w, le, []uint16{16, 16, 16, 16})
+
+	_ = binary.Write(w, le, uint16(len(entries)))
+	for _, e := range entries {
+		_ = binary.Write(w, le, e.tag)
+		_ = binary.Write(w, le, e.kind)
+		_ = binary.Write(w, le, e.count)
+		// Short values sit left justified in the value field.
+		if e.kind == tiffShort && e.count == 1 {
+			_ = binary.Write(w, le, []uint16{uint16(e.value), 0})
+		} else {
+			_ = binary.Write(w, le, e.value)
+		}
+	}
+	// No more IFDs
+	_ = binary.Write(w, le, uint32(0))
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
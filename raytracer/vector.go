@@ -252,6 +252,24 @@ func vectorLength(v Vector) float64 {
 	return math.Sqrt(vectorNorm(v))
 }
 
+// tangentFrame is the tangent and bitangent completing an orthonormal basis with the normal.
+func tangentFrame(normal Vector) (Vector, Vector) {
+	// Duff et al. branchless orthonormal basis.
+	sign := math.Copysign(1, normal[2])
+	a := -1 / (sign + normal[2])
+	b := normal[0] * normal[1] * a
+	tangent := Vector{1 + sign*normal[0]*normal[0]*a, sign * b, -sign * normal[0], 0}
+	bitangent := Vector{b, sign + normal[1]*normal[1]*a, -normal[1], 0}
+	return tangent, bitangent
+}
+
+// tangentToWorld turns x, y, z of the frame around the normal, z along
+// the normal, into a world direction.
+func tangentToWorld(normal Vector, x, y, z float64) Vector {
+	tangent, bitangent := tangentFrame(normal)
+	return combine(combine(tangent, bitangent, x, y), normal, 1, z)
+}
+
 func reflectVector(v, n Vector) Vector {
 	return combine(v, n, 1.0, -2*dot(v, n))
 }